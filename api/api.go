@@ -1,7 +1,11 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"sync"
+	"time"
 
 	"github.com/labstack/gommon/random"
 	log "github.com/sirupsen/logrus"
@@ -15,129 +19,576 @@ import (
 
 const idsize = 32
 
+const errorDrainTimeout = "timed out waiting for in-flight requests"
+
+const defaultReconnectDelay = time.Second
+
+const contentTypeJSON = "application/json"
+
+const (
+	statusSent     = "sent"
+	statusInvalid  = "invalid"
+	statusRejected = "rejected"
+	statusRetrying = "retrying"
+	statusFailed   = "failed"
+	statusPartial  = "partial"
+)
+
+// typeBatch is the type of deliveries carrying batch requests.
+const typeBatch = "batch"
+
 type ErrorMarshaler func(error) interface{}
 
+// result represents an outcome of a request published to the results
+// exchange and to the request ReplyTo queue. Outcomes of batch requests
+// contain a result per recipient.
+type result struct {
+	ID            string          `json:"id"`
+	CorrelationID string          `json:"correlationId,omitempty"`
+	Status        string          `json:"status"`
+	MessageID     string          `json:"messageId,omitempty"`
+	Lang          string          `json:"lang,omitempty"`
+	To            []model.Address `json:"to,omitempty"`
+	Errors        json.Marshaler  `json:"errors,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	Results       []result        `json:"results,omitempty"`
+}
+
+type retryAfter interface {
+	RetryAfter() time.Duration
+}
+
+// Config represents AMQP API configuration.
+type Config struct {
+	// URL is the broker URL.
+	URL string
+	// QName is the name of the requests exchange and queue.
+	QName string
+	// Requeue defines whether failed requests are requeued if no retry
+	// delays are configured.
+	Requeue bool
+	// Delays are the delays before each retry of a failed request. A request
+	// failed after the last retry is parked in the dead-letter queue.
+	Delays []time.Duration
+	// Workers is the number of requests processed concurrently.
+	Workers int
+	// Prefetch is the number of unacknowledged requests the broker delivers
+	// ahead, unlimited if zero.
+	Prefetch int
+	// ReconnectDelay is the delay before the first reconnection attempt, it
+	// doubles on each failed attempt.
+	ReconnectDelay time.Duration
+	// ReconnectMaxDelay limits the delay between reconnection attempts.
+	ReconnectMaxDelay time.Duration
+	// Results is the name of the exchange receiving every request outcome,
+	// results are not published if empty.
+	Results string
+}
+
 // Api represents sendmail AMQP API.
 type Api struct {
-	ap      *app.App
-	ch      *amqp.Channel
-	rq      <-chan amqp.Delivery
-	requeue bool
+	ap    *app.App
+	cfg   Config
+	tag   string
+	mutex sync.Mutex
+	ss    *session
+	once  sync.Once
+	quit  chan struct{}
+	done  chan struct{}
 }
 
-// New creates new Api.
-func New(ap *app.App, qname string, requeue bool, cn *amqp.Connection) (*Api, error) {
-	var err error
+// New creates new Api connected to the broker.
+func New(ap *app.App, cfg Config) (*Api, error) {
+	tag := random.String(idsize)
 
-	ch, err := cn.Channel()
+	ss, err := connect(cfg, tag)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func() {
-		if err != nil {
-			ch.Close()
+	api := Api{
+		ap:   ap,
+		cfg:  cfg,
+		tag:  tag,
+		ss:   ss,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	return &api, nil
+}
+
+// Start starts listening for email requests. Requests are processed by
+// the configured number of workers, each delivery is acknowledged
+// individually once processed. If the connection is lost Start reconnects
+// and resumes consuming. Start returns after Shutdown.
+func (self *Api) Start() {
+	defer close(self.done)
+
+	ss := self.session()
+	for {
+		self.consume(ss)
+
+		select {
+		case <-self.quit:
+			return
+		default:
 		}
-	}()
 
-	err = ch.ExchangeDeclare(
-		qname,    // name
-		"direct", // type
-		true,     // durable
-		false,    // auto-deleted
-		false,    // internal
-		false,    // no-wait
-		nil,      // arguments
-	)
-	if err != nil {
-		return nil, err
+		if ss = self.reconnect(ss); ss == nil {
+			return
+		}
+	}
+}
+
+func (self *Api) consume(ss *session) {
+	workers := self.cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+
+	for n := 0; n < workers; n++ {
+		go func() {
+			defer wg.Done()
+			for i := range ss.rq {
+				select {
+				case <-self.quit:
+					i.Nack(false, true)
+				default:
+					self.handle(ss, i)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// reconnect re-establishes the session with exponential backoff. It returns
+// nil if Shutdown is called while reconnecting.
+func (self *Api) reconnect(old *session) *session {
+	old.close()
+
+	delay := self.cfg.ReconnectDelay
+	if delay <= 0 {
+		delay = defaultReconnectDelay
+	}
+
+	for {
+		log.WithFields(log.Fields{
+			"delay": delay.String(),
+		}).Warn("connection lost, reconnecting")
+
+		select {
+		case <-self.quit:
+			return nil
+		case <-time.After(delay):
+		}
+
+		ss, err := connect(self.cfg, self.tag)
+		if err == nil {
+			self.mutex.Lock()
+			self.ss = ss
+			self.mutex.Unlock()
+
+			log.Info("reconnected")
+			return ss
+		}
+
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("unable to reconnect")
+
+		delay *= 2
+		if self.cfg.ReconnectMaxDelay > 0 && delay > self.cfg.ReconnectMaxDelay {
+			delay = self.cfg.ReconnectMaxDelay
+		}
 	}
+}
+
+func (self *Api) session() *session {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.ss
+}
 
-	qe, err := ch.QueueDeclare(
-		qname, // name
-		true,  // durable
-		false, // delete when usused
-		false, // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
+// Shutdown stops consuming and waits until in-flight requests are processed
+// or the timeout expires. Requests delivered but not yet started are
+// returned to the queue.
+func (self *Api) Shutdown(timeout time.Duration) error {
+	self.once.Do(func() {
+		close(self.quit)
+	})
+
+	if err := self.session().ch.Cancel(self.tag, false); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("unable to cancel consumer")
+	}
+
+	select {
+	case <-self.done:
+		return nil
+	case <-time.After(timeout):
+		return errors.New(errorDrainTimeout)
+	}
+}
+
+// Done gets a channel closed when Start returns.
+func (self *Api) Done() <-chan struct{} {
+	return self.done
+}
+
+// Close closes the underlying channel and connection.
+func (self *Api) Close() error {
+	return self.session().close()
+}
+
+func (self *Api) handle(ss *session, i amqp.Delivery) {
+	if i.Type == typeBatch {
+		self.handleBatch(ss, i)
+		return
+	}
+
+	reqid := random.String(idsize)
+	res := result{ID: reqid, CorrelationID: i.CorrelationId}
+
+	rc, err := sendmail(reqid, self.ap, i)
 	if err != nil {
-		return nil, err
+		switch err.(type) {
+		case app.ArgumentError:
+			res.Errors = marshal(err.(app.ArgumentError).Errors())
+			log.WithFields(log.Fields{
+				"id":    reqid,
+				"error": res.Errors,
+			}).Error("invalid request")
+			res.Status = self.deadLetter(ss, reqid, i, i.Body, statusInvalid)
+		case app.PermanentError:
+			log.WithFields(log.Fields{
+				"id":    reqid,
+				"error": err,
+			}).Error("email rejected")
+			res.Status = self.deadLetter(ss, reqid, i, i.Body, statusRejected)
+			res.Error = err.Error()
+		case app.TemplateError:
+			res.Errors = marshal(err.(app.TemplateError).Errors())
+			log.WithFields(log.Fields{
+				"id":    reqid,
+				"error": res.Errors,
+			}).Error("invalid template")
+			res.Status = self.deadLetter(ss, reqid, i, i.Body, statusFailed)
+		default:
+			log.WithFields(log.Fields{
+				"id":    reqid,
+				"error": err,
+			}).Error("unable to send email")
+			res.Status = self.retry(ss, reqid, i, i.Body, err)
+			res.Error = err.Error()
+		}
+	} else {
+		res.Status = statusSent
+		res.MessageID = rc.MessageID
+		res.Lang = rc.Lang
+		i.Ack(false)
 	}
 
-	err = ch.QueueBind(
-		qe.Name, // queue name
-		qname,   // routing key
-		qname,   // exchange
-		false,   // no-wait
-		nil,     // arguments
-	)
+	self.publish(ss, reqid, i, res)
+}
+
+// handleBatch sends the emails of a batch delivery. Recipients failed with
+// transient errors are retried as a batch of their own, recipients failed
+// with template errors are parked in the dead-letter queue as a batch of
+// their own, other recipients are not sent twice. The batch status is the
+// status shared by all recipients or partial.
+func (self *Api) handleBatch(ss *session, i amqp.Delivery) {
+	reqid := random.String(idsize)
+	res := result{ID: reqid, CorrelationID: i.CorrelationId}
+
+	req, results, err := sendbatch(reqid, self.ap, i)
 	if err != nil {
-		return nil, err
+		switch err.(type) {
+		case app.ArgumentError:
+			res.Errors = marshal(err.(app.ArgumentError).Errors())
+			log.WithFields(log.Fields{
+				"id":    reqid,
+				"error": res.Errors,
+			}).Error("invalid batch")
+			res.Status = statusInvalid
+		default:
+			log.WithFields(log.Fields{
+				"id":    reqid,
+				"error": err,
+			}).Error("batch rejected")
+			res.Status = statusRejected
+			res.Error = err.Error()
+		}
+		res.Status = self.deadLetter(ss, reqid, i, i.Body, res.Status)
+		self.publish(ss, reqid, i, res)
+		return
+	}
+
+	res.Results = make([]result, len(results))
+	failed, parked := []model.Recipient{}, []model.Recipient{}
+	retried, dead := []int{}, []int{}
+	var failure error
+
+	for n, br := range results {
+		out := result{ID: random.String(idsize), To: req.Recipients[n].To}
+
+		switch err := br.Err; err.(type) {
+		case nil:
+			out.Status = statusSent
+			out.MessageID = br.Receipt.MessageID
+			out.Lang = br.Receipt.Lang
+		case app.ArgumentError:
+			out.Status = statusInvalid
+			out.Errors = marshal(err.(app.ArgumentError).Errors())
+		case app.PermanentError:
+			out.Status = statusRejected
+			out.Error = err.Error()
+		case app.TemplateError:
+			out.Errors = marshal(err.(app.TemplateError).Errors())
+			parked, dead = append(parked, req.Recipients[n]), append(dead, n)
+		default:
+			out.Error = err.Error()
+			failed, retried, failure = append(failed, req.Recipients[n]), append(retried, n), err
+		}
+
+		res.Results[n] = out
 	}
 
-	reqs, err := ch.Consume(
-		qe.Name, // queue
-		"",      // consumer
-		false,   // auto-ack
-		false,   // exclusive
-		false,   // no-local
-		false,   // no-wait
-		nil,     // arguments
-	)
+	if len(parked) > 0 {
+		log.WithFields(log.Fields{
+			"id":     reqid,
+			"failed": len(parked),
+		}).Error("invalid batch template")
+
+		body := subset(i, req, parked)
+		status := statusFailed
+		if len(failed) == 0 {
+			status = self.deadLetter(ss, reqid, i, body, status)
+		} else if err := forward(ss, self.cfg.QName+suffixDLX, self.cfg.QName, i, body); err != nil {
+			log.WithFields(log.Fields{
+				"id":    reqid,
+				"body":  string(body),
+				"error": err,
+			}).Error("unable to dead-letter batch recipients, dropping")
+		}
+		for _, n := range dead {
+			res.Results[n].Status = status
+		}
+	}
+
+	if len(failed) > 0 {
+		log.WithFields(log.Fields{
+			"id":     reqid,
+			"failed": len(failed),
+			"error":  failure,
+		}).Error("unable to send batch emails")
+
+		status := self.retry(ss, reqid, i, subset(i, req, failed), failure)
+		for _, n := range retried {
+			res.Results[n].Status = status
+		}
+	}
+
+	if len(parked) == 0 && len(failed) == 0 {
+		i.Ack(false)
+	}
+
+	res.Status = batchStatus(res.Results)
+
+	self.publish(ss, reqid, i, res)
+}
+
+// subset gets the body of the batch delivery restricted to the recipients
+// provided, the delivery body is kept if all recipients are provided.
+func subset(i amqp.Delivery, req model.BatchRequest, recs []model.Recipient) []byte {
+	if len(recs) == len(req.Recipients) {
+		return i.Body
+	}
+
+	req.Recipients = recs
+	body, err := json.Marshal(req)
 	if err != nil {
-		return nil, err
+		return i.Body
 	}
+	return body
+}
 
-	return &Api{ap: ap, ch: ch, requeue: requeue, rq: reqs}, nil
+// batchStatus gets the status shared by all recipients. A batch having
+// recipients retried is retrying, otherwise it is partial.
+func batchStatus(results []result) string {
+	status := results[0].Status
+	for _, out := range results {
+		if out.Status == statusRetrying {
+			return statusRetrying
+		}
+		if out.Status != status {
+			status = statusPartial
+		}
+	}
+	return status
 }
 
-// Start starts listening for email requests.
-func (self *Api) Start() {
-	for i := range self.rq {
-		reqid := random.String(idsize)
-
-		err := sendmail(reqid, self.ap, i)
-		if err != nil {
-			switch err.(type) {
-			case app.ArgumentError:
-				log.WithFields(log.Fields{
-					"id": reqid,
-					"error": marshal(
-						err.(app.ArgumentError).Err.(validation.Errors)),
-				}).Error("invalid request")
-				i.Nack(false, false)
-			case app.TemplateError:
-
-				log.WithFields(log.Fields{
-					"id": reqid,
-					"error": marshal(
-						err.(app.TemplateError).Err.(validation.Errors)),
-				}).Error("invalid template")
-				i.Nack(false, self.requeue)
-			default:
-				log.WithFields(log.Fields{
-					"id":    reqid,
-					"error": err,
-				}).Error("unable to send email")
-				i.Nack(false, self.requeue)
+// retry schedules the delivery with the body provided to the next retry
+// queue or parks it in the dead-letter queue if all retries are exhausted.
+// If no retry delays are configured the delivery is requeued according to
+// the Requeue option once the delay requested by a rate limit passed or
+// Shutdown is called, a changed body is published to the requests exchange
+// instead. The resulting request status is returned.
+func (self *Api) retry(ss *session, reqid string, i amqp.Delivery, body []byte, err error) string {
+	if len(self.cfg.Delays) == 0 {
+		if !self.cfg.Requeue {
+			return self.deadLetter(ss, reqid, i, body, statusFailed)
+		}
+		if ra, ok := err.(retryAfter); ok {
+			select {
+			case <-time.After(ra.RetryAfter()):
+			case <-self.quit:
 			}
-		} else {
-			i.Ack(false)
 		}
+		if bytes.Equal(body, i.Body) {
+			i.Nack(false, true)
+			return statusRetrying
+		}
+		return self.move(ss, reqid, i, self.cfg.QName, self.cfg.QName, body, statusRetrying)
 	}
+
+	n := attempts(i.Headers)
+	if n >= len(self.cfg.Delays) {
+		log.WithFields(log.Fields{
+			"id":       reqid,
+			"attempts": n,
+		}).Error("retries exhausted, dead-lettering")
+		return self.deadLetter(ss, reqid, i, body, statusFailed)
+	}
+
+	delay := self.cfg.Delays[n]
+
+	log.WithFields(log.Fields{
+		"id":      reqid,
+		"attempt": n + 1,
+		"delay":   delay.String(),
+	}).Info("scheduling retry")
+
+	// The retried copy carries the attempt, the delivery itself is acked.
+	i.Headers = attempt(i.Headers, n+1)
+	return self.move(ss, reqid, i, "", delayQueue(self.cfg.QName, delay), body, statusRetrying)
 }
 
-// Close closes the underlying channel.
-func (self *Api) Close() error {
-	return self.ch.Close()
+// deadLetter parks the body provided in the dead-letter queue and acks the
+// delivery.
+func (self *Api) deadLetter(ss *session, reqid string, i amqp.Delivery, body []byte, status string) string {
+	return self.move(ss, reqid, i, self.cfg.QName+suffixDLX, self.cfg.QName, body, status)
 }
 
-func sendmail(reqid string, ap *app.App, i amqp.Delivery) error {
+// move publishes the body provided and acks the delivery once the broker
+// confirmed the publish, the status provided is returned. If the publish
+// fails the delivery is requeued and its status is retrying, unless the
+// body is a part of the delivery body: the delivery is acked then so the
+// emails already sent are not sent twice, the body is logged and its status
+// is failed.
+func (self *Api) move(ss *session, reqid string, i amqp.Delivery, exchange, key string, body []byte, status string) string {
+	err := forward(ss, exchange, key, i, body)
+	if err == nil {
+		i.Ack(false)
+		return status
+	}
+
+	if bytes.Equal(body, i.Body) {
+		log.WithFields(log.Fields{
+			"id":       reqid,
+			"exchange": exchange,
+			"key":      key,
+			"error":    err,
+		}).Error("unable to move request, requeueing")
+		i.Nack(false, true)
+		return statusRetrying
+	}
+
+	log.WithFields(log.Fields{
+		"id":       reqid,
+		"exchange": exchange,
+		"key":      key,
+		"body":     string(body),
+		"error":    err,
+	}).Error("unable to move batch recipients, dropping")
+	i.Ack(false)
+	return statusFailed
+}
+
+// forward publishes a copy of the delivery with the body provided.
+func forward(ss *session, exchange, key string, i amqp.Delivery, body []byte) error {
+	msg := amqp.Publishing{
+		Headers:         i.Headers,
+		ContentType:     i.ContentType,
+		ContentEncoding: i.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		CorrelationId:   i.CorrelationId,
+		ReplyTo:         i.ReplyTo,
+		MessageId:       i.MessageId,
+		Timestamp:       i.Timestamp,
+		Type:            i.Type,
+		AppId:           i.AppId,
+		Body:            body,
+	}
+
+	return ss.publish(exchange, key, msg)
+}
+
+// publish publishes the request result to the results exchange if
+// configured, using the status as routing key, and replies to the delivery
+// ReplyTo queue once the request reached its final status.
+func (self *Api) publish(ss *session, reqid string, i amqp.Delivery, res result) {
+	reply := i.ReplyTo != "" && res.Status != statusRetrying
+	if self.cfg.Results == "" && !reply {
+		return
+	}
+
+	body, err := json.Marshal(res)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":    reqid,
+			"error": err,
+		}).Error("unable to marshal result")
+		return
+	}
+
+	msg := amqp.Publishing{
+		ContentType:   contentTypeJSON,
+		CorrelationId: i.CorrelationId,
+		Timestamp:     time.Now(),
+		Body:          body,
+	}
+
+	if self.cfg.Results != "" {
+		if err := ss.publish(self.cfg.Results, res.Status, msg); err != nil {
+			log.WithFields(log.Fields{
+				"id":    reqid,
+				"error": err,
+			}).Error("unable to publish result")
+		}
+	}
+
+	if reply {
+		if err := ss.publish("", i.ReplyTo, msg); err != nil {
+			log.WithFields(log.Fields{
+				"id":    reqid,
+				"error": err,
+			}).Error("unable to publish reply")
+		}
+	}
+}
+
+func sendmail(reqid string, ap *app.App, i amqp.Delivery) (model.Receipt, error) {
 	req := model.Request{}
 
 	if err := json.Unmarshal(i.Body, &req); err != nil {
-		return err
+		return model.Receipt{}, app.PermanentError{Err: err}
 	}
 
 	log.WithFields(log.Fields{
@@ -145,16 +596,44 @@ func sendmail(reqid string, ap *app.App, i amqp.Delivery) error {
 		"id":      reqid,
 	}).Debug("request received")
 
-	if err := ap.SendMail(req); err != nil {
-		return err
+	rc, err := ap.SendMail(req)
+	if err != nil {
+		return rc, err
 	}
 
 	log.WithFields(log.Fields{
-		"request": req,
-		"id":      reqid,
+		"request":   req,
+		"id":        reqid,
+		"messageId": rc.MessageID,
+		"lang":      rc.Lang,
 	}).Debug("request completed")
 
-	return nil
+	return rc, nil
+}
+
+func sendbatch(reqid string, ap *app.App, i amqp.Delivery) (model.BatchRequest, []app.BatchResult, error) {
+	req := model.BatchRequest{}
+
+	if err := json.Unmarshal(i.Body, &req); err != nil {
+		return req, nil, app.PermanentError{Err: err}
+	}
+
+	log.WithFields(log.Fields{
+		"id":         reqid,
+		"recipients": len(req.Recipients),
+	}).Debug("batch received")
+
+	results, err := ap.SendBatch(req)
+	if err != nil {
+		return req, nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"id":         reqid,
+		"recipients": len(req.Recipients),
+	}).Debug("batch completed")
+
+	return req, results, nil
 }
 
 func marshal(err validation.Errors) json.Marshaler {
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"errors"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	errorPublishNacked = "publish rejected by the broker"
+	errorPublishLost   = "channel closed before the publish was confirmed"
+)
+
+// session represents a connection to the broker consuming requests.
+// Publishes are confirmed by the broker.
+type session struct {
+	cn    *amqp.Connection
+	ch    *amqp.Channel
+	rq    <-chan amqp.Delivery
+	cf    <-chan amqp.Confirmation
+	mutex sync.Mutex
+}
+
+// connect connects to the broker, declares the topology and starts
+// consuming requests.
+func connect(cfg Config, tag string) (*session, error) {
+	var err error
+
+	cn, err := amqp.Dial(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			cn.Close()
+		}
+	}()
+
+	ch, err := cn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = declare(ch, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ch.Confirm(false)
+	if err != nil {
+		return nil, err
+	}
+
+	cf := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	if cfg.Prefetch > 0 {
+		err = ch.Qos(
+			cfg.Prefetch, // prefetch count
+			0,            // prefetch size
+			false,        // global
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reqs, err := ch.Consume(
+		cfg.QName, // queue
+		tag,       // consumer
+		false,     // auto-ack
+		false,     // exclusive
+		false,     // no-local
+		false,     // no-wait
+		nil,       // arguments
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &session{cn: cn, ch: ch, rq: reqs, cf: cf}
+	go ss.watch()
+
+	return ss, nil
+}
+
+// watch logs the connection or channel close reason. If only the channel
+// is closed, the connection is closed as well so the whole session is
+// re-established.
+func (ss *session) watch() {
+	cnc := ss.cn.NotifyClose(make(chan *amqp.Error, 1))
+	chc := ss.ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	select {
+	case err, ok := <-cnc:
+		if ok {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("connection closed")
+		}
+	case err, ok := <-chc:
+		if ok {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("channel closed")
+		}
+		ss.cn.Close()
+	}
+}
+
+// publish publishes the message and waits until the broker confirms it.
+// Publishes are serialized so each confirmation matches its message.
+func (ss *session) publish(exchange, key string, msg amqp.Publishing) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if err := ss.ch.Publish(exchange, key, false, false, msg); err != nil {
+		return err
+	}
+
+	cf, ok := <-ss.cf
+	if !ok {
+		return errors.New(errorPublishLost)
+	}
+	if !cf.Ack {
+		return errors.New(errorPublishNacked)
+	}
+
+	return nil
+}
+
+// close closes the channel and the connection.
+func (ss *session) close() error {
+	ss.ch.Close()
+	return ss.cn.Close()
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	suffixDLX   = ".dlx"
+	suffixDLQ   = ".dlq"
+	suffixRetry = ".retry."
+
+	headerAttempt = "x-sendmail-attempt"
+)
+
+// declare declares the AMQP topology:
+//   - the requests exchange and queue named qname, the queue is declared
+//     without arguments so queues created by earlier versions are reused;
+//   - the qname.dlq queue bound to qname.dlx which keeps failed messages for
+//     inspection, failed messages are published there by the service;
+//   - a qname.retry.<delay> queue per retry delay, messages expire there
+//     after the delay and are dead-lettered back to the requests exchange;
+//   - the results topic exchange if configured.
+func declare(ch *amqp.Channel, cfg Config) error {
+	dlx := cfg.QName + suffixDLX
+
+	if err := exchange(ch, cfg.QName); err != nil {
+		return err
+	}
+
+	if err := exchange(ch, dlx); err != nil {
+		return err
+	}
+
+	if cfg.Results != "" {
+		err := ch.ExchangeDeclare(
+			cfg.Results, // name
+			"topic",     // type
+			true,        // durable
+			false,       // auto-deleted
+			false,       // internal
+			false,       // no-wait
+			nil,         // arguments
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := queue(ch, cfg.QName, cfg.QName, cfg.QName, nil); err != nil {
+		return err
+	}
+
+	if err := queue(ch, cfg.QName+suffixDLQ, dlx, cfg.QName, nil); err != nil {
+		return err
+	}
+
+	for _, delay := range cfg.Delays {
+		_, err := ch.QueueDeclare(
+			delayQueue(cfg.QName, delay), // name
+			true,                         // durable
+			false,                        // delete when usused
+			false,                        // exclusive
+			false,                        // no-wait
+			amqp.Table{ // arguments
+				"x-message-ttl":             int64(delay / time.Millisecond),
+				"x-dead-letter-exchange":    cfg.QName,
+				"x-dead-letter-routing-key": cfg.QName,
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func exchange(ch *amqp.Channel, name string) error {
+	return ch.ExchangeDeclare(
+		name,     // name
+		"direct", // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+}
+
+func queue(ch *amqp.Channel, name, exchange, key string, args amqp.Table) error {
+	qe, err := ch.QueueDeclare(
+		name,  // name
+		true,  // durable
+		false, // delete when usused
+		false, // exclusive
+		false, // no-wait
+		args,  // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	return ch.QueueBind(
+		qe.Name,  // queue name
+		key,      // routing key
+		exchange, // exchange
+		false,    // no-wait
+		nil,      // arguments
+	)
+}
+
+func delayQueue(qname string, delay time.Duration) string {
+	return fmt.Sprintf("%s%s%s", qname, suffixRetry, delay)
+}
+
+// attempts gets the number of retries the delivery went through. The count
+// is kept by the service in its own header, the x-death header is not used
+// as brokers handle it differently for republished messages.
+func attempts(headers amqp.Table) int {
+	switch n := headers[headerAttempt].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	}
+	return 0
+}
+
+// attempt gets a copy of the headers with the retry attempt provided.
+func attempt(headers amqp.Table, n int) amqp.Table {
+	out := amqp.Table{}
+	for k, v := range headers {
+		out[k] = v
+	}
+	out[headerAttempt] = int32(n)
+	return out
+}
@@ -2,10 +2,10 @@ package app
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 	"io/ioutil"
-	"text/template"
+	"strings"
+	"time"
 
 	"github.com/vbogretsov/go-validation"
 	"gopkg.in/yaml.v2"
@@ -16,6 +16,10 @@ import (
 // ErrLoadTemplate defines error message if template not found.
 var ErrLoadTemplate = "cannot load template"
 
+// ErrUnescapedBody defines error message if an HTML body is not separated
+// from the header and so cannot be escaped.
+var ErrUnescapedBody = "html body must follow the header after a --- line"
+
 var (
 	// ParamTemplateLang defines key name for error parameter template lang.
 	ParamTemplateLang = "lang"
@@ -35,7 +39,13 @@ func (e ArgumentError) Error() string {
 	return e.Err.Error()
 }
 
-// TemplateError represents error caused by invalid template
+// Errors gets the validation errors caused the argument error.
+func (e ArgumentError) Errors() validation.Errors {
+	return errorsOf(e.Err)
+}
+
+// TemplateError represents error caused by invalid template, e.g. the
+// template cannot be parsed or executed or produced an invalid message.
 type TemplateError struct {
 	Err error
 }
@@ -45,66 +55,209 @@ func (e TemplateError) Error() string {
 	return e.Err.Error()
 }
 
+// Errors gets the validation errors caused the template error, parse and
+// execution errors are reported as a single error.
+func (e TemplateError) Errors() validation.Errors {
+	return errorsOf(e.Err)
+}
+
+func errorsOf(err error) validation.Errors {
+	if errs, ok := err.(validation.Errors); ok {
+		return errs
+	}
+	return validation.Errors([]error{validation.Error{Message: err.Error()}})
+}
+
+// PermanentError represents a send failure which will never succeed if
+// retried, e.g. the provider rejected the message.
+type PermanentError struct {
+	Err error
+}
+
+// Error gets string representation of a permanent error.
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Temporary reports whether the error is temporary.
+func (e PermanentError) Temporary() bool {
+	return false
+}
+
+// TransientError represents a send failure which may succeed if retried,
+// e.g. the provider is unavailable.
+type TransientError struct {
+	Err error
+}
+
+// Error gets string representation of a transient error.
+func (e TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// Temporary reports whether the error is temporary.
+func (e TransientError) Temporary() bool {
+	return true
+}
+
+// RateLimitError represents a send failure caused by provider rate limits.
+type RateLimitError struct {
+	Err   error
+	After time.Duration
+}
+
+// Error gets string representation of a rate limit error.
+func (e RateLimitError) Error() string {
+	return e.Err.Error()
+}
+
+// Temporary reports whether the error is temporary.
+func (e RateLimitError) Temporary() bool {
+	return true
+}
+
+// RetryAfter gets the time to wait before the next attempt.
+func (e RateLimitError) RetryAfter() time.Duration {
+	return e.After
+}
+
+type temporary interface {
+	Temporary() bool
+}
+
+// IsTransient reports whether the send error may succeed if retried, errors
+// not telling whether they are temporary are considered transient.
+func IsTransient(err error) bool {
+	if t, ok := err.(temporary); ok {
+		return t.Temporary()
+	}
+	return true
+}
+
 // Loader represents interface of templates loader.
 type Loader interface {
 	// Load loads a template with the language and name provided.
 	Load(lang, name string) (io.Reader, error)
+	// LoadFile loads a layout, partial or asset with the language and file
+	// name provided, shared files have the empty language.
+	LoadFile(lang, file string) (io.Reader, error)
 }
 
-// Sender represent inteface for an email sender.
+// Entry identifies a template provided by a loader.
+type Entry struct {
+	Lang string
+	Name string
+	// Source is the template location, e.g. a file path.
+	Source string
+}
+
+// Lister represents interface of loaders able to enumerate their templates.
+type Lister interface {
+	// List gets all templates available.
+	List() ([]Entry, error)
+}
+
+// Notifier represents interface of loaders reporting changed templates.
+type Notifier interface {
+	// Notify registers a function called with the language and name of each
+	// changed template.
+	Notify(fn func(lang, name string))
+}
+
+// Sender represent inteface for an email sender. Send returns the message
+// id assigned by the provider. Send failures should be reported as
+// PermanentError, TransientError or RateLimitError, other errors are
+// considered transient.
 type Sender interface {
-	Send(model.Message) error
+	Send(model.Message) (string, error)
+}
+
+// BatchSender represents interface of senders able to send several messages
+// at once, e.g. in a single provider call. A message id and an error are
+// returned per message in the same order.
+type BatchSender interface {
+	SendBatch([]model.Message) ([]string, []error)
+}
+
+// Config represents mail app configuration.
+type Config struct {
+	// Cache caches compiled templates, templates are loaded and parsed for
+	// each email if nil.
+	Cache *Cache
+	// Fallback is the language used if a template is not available neither
+	// in the requested language nor in its parent languages.
+	Fallback string
+	// DeriveText derives the plain text alternative of HTML bodies from the
+	// HTML if the template does not define one.
+	DeriveText bool
 }
 
 // App represents a maild application.
 type App struct {
 	loader Loader
 	sender Sender
+	cfg    Config
 }
 
-// New creates a new mail app.
-func New(loader Loader, sender Sender) *App {
+// New creates a new mail app. If the loader is a Notifier changed templates
+// are evicted from the cache.
+func New(loader Loader, sender Sender, cfg Config) *App {
+	if nt, ok := loader.(Notifier); ok && cfg.Cache != nil {
+		nt.Notify(cfg.Cache.Invalidate)
+	}
+
 	return &App{
 		loader: loader,
 		sender: sender,
+		cfg:    cfg,
 	}
 }
 
 // SendMail build email from template and sends it.
-func (ap *App) SendMail(req model.Request) error {
+func (ap *App) SendMail(req model.Request) (model.Receipt, error) {
 	if err := requestRule(&req); err != nil {
-		return ArgumentError{err}
+		return model.Receipt{}, ArgumentError{err}
 	}
 
-	body, err := ap.loader.Load(req.TemplateLang, req.TemplateName)
+	msg, err := ap.render(req)
 	if err != nil {
-		e := validation.Error{
-			Message: ErrLoadTemplate,
-			Params: validation.Params{
-				ParamTemplateLang:  req.TemplateLang,
-				ParamTemplateName:  req.TemplateName,
-				ParamTemplateCause: err.Error(),
-			},
-		}
+		return model.Receipt{}, err
+	}
 
-		return ArgumentError{Err: validation.Errors([]error{e})}
+	id, err := ap.sender.Send(msg)
+	if err != nil {
+		return model.Receipt{}, err
 	}
 
-	key := fmt.Sprintf("%s-%s", req.TemplateLang, req.TemplateName)
+	return model.Receipt{MessageID: id, Lang: msg.Lang}, nil
+}
 
-	text, err := ioutil.ReadAll(body)
-	if err != nil {
-		return err
+// Render builds email from template without sending it. Unlike SendMail
+// recipients are optional.
+func (ap *App) Render(req model.Request) (model.Message, error) {
+	if err := renderRule(&req); err != nil {
+		return model.Message{}, ArgumentError{err}
 	}
 
-	tml, err := template.New(key).Parse(string(text))
+	return ap.render(req)
+}
+
+func (ap *App) render(req model.Request) (model.Message, error) {
+	tml, lang, err := ap.compile(req.TemplateLang, req.TemplateName)
 	if err != nil {
-		return err
+		return model.Message{}, err
 	}
 
+	return ap.build(tml, lang, req, nil)
+}
+
+// build executes the template found in the language provided. The assets
+// loaded for the template attachments are kept in loaded, so they are loaded
+// once for all emails of a batch, nothing is kept if loaded is nil.
+func (ap *App) build(tml *compiled, lang string, req model.Request, loaded map[string]string) (model.Message, error) {
 	buf := new(bytes.Buffer)
-	if err := tml.Execute(buf, req.TemplateArgs); err != nil {
-		return err
+	if err := tml.header.Execute(buf, req.TemplateArgs); err != nil {
+		return model.Message{}, TemplateError{Err: err}
 	}
 
 	msg := model.Message{
@@ -113,9 +266,40 @@ func (ap *App) SendMail(req model.Request) error {
 		Bcc: []model.Address{},
 	}
 	if err := yaml.Unmarshal(buf.Bytes(), &msg); err != nil {
-		return err
+		return model.Message{}, TemplateError{Err: err}
 	}
 
+	if tml.text != nil {
+		var err error
+		body := new(bytes.Buffer)
+		if msg.BodyType == bodyTypeHTML {
+			err = tml.html.Execute(body, req.TemplateArgs)
+		} else {
+			err = tml.text.Execute(body, req.TemplateArgs)
+		}
+		if err != nil {
+			return model.Message{}, TemplateError{Err: err}
+		}
+		msg.Body = body.String()
+	} else if msg.BodyType == bodyTypeHTML {
+		e := validation.Error{Message: ErrUnescapedBody}
+		return model.Message{}, TemplateError{Err: validation.Errors([]error{e})}
+	}
+
+	if tml.alt != nil {
+		text := new(bytes.Buffer)
+		if err := tml.alt.Execute(text, req.TemplateArgs); err != nil {
+			return model.Message{}, TemplateError{Err: err}
+		}
+		msg.Text = text.String()
+	}
+
+	if msg.Text == "" && msg.BodyType == bodyTypeHTML && ap.cfg.DeriveText {
+		msg.Text = plain(msg.Body)
+	}
+
+	msg.Lang = lang
+
 	for _, rec := range req.To {
 		msg.To = append(msg.To, rec)
 	}
@@ -128,9 +312,146 @@ func (ap *App) SendMail(req model.Request) error {
 		msg.Bcc = append(msg.Bcc, rec)
 	}
 
+	if len(req.ReplyTo) > 0 {
+		msg.ReplyTo = req.ReplyTo
+	}
+
+	msg.Headers = mergeHeaders(msg.Headers, req.Headers)
+	msg.Tags = mergeTags(msg.Tags, req.Tags)
+	msg.Metadata = mergeMetadata(msg.Metadata, req.Metadata)
+
+	if err := ap.attach(lang, msg.Attachments, loaded); err != nil {
+		return model.Message{}, TemplateError{Err: err}
+	}
+
+	atts := append([]model.Attachment{}, req.Attachments...)
+	if err := ap.attach(lang, atts, nil); err != nil {
+		return model.Message{}, ArgumentError{Err: err}
+	}
+	msg.Attachments = append(msg.Attachments, atts...)
+
 	if err := messageRule(&msg); err != nil {
-		return TemplateError{Err: err}
+		return model.Message{}, TemplateError{Err: err}
+	}
+
+	return msg, nil
+}
+
+// mergeHeaders adds the request headers to the template ones, header names
+// are case insensitive.
+func mergeHeaders(tml, req map[string]string) map[string]string {
+	if len(req) == 0 {
+		return tml
+	}
+
+	out := map[string]string{}
+	for name, value := range tml {
+		out[name] = value
+	}
+
+	for name, value := range req {
+		for key := range out {
+			if strings.EqualFold(key, name) {
+				delete(out, key)
+			}
+		}
+		out[name] = value
+	}
+	return out
+}
+
+func mergeTags(tml, req []string) []string {
+	out := tml
+	for _, tag := range req {
+		if !contains(out, tag) {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeMetadata(tml, req map[string]string) map[string]string {
+	if len(req) == 0 {
+		return tml
 	}
 
-	return ap.sender.Send(msg)
+	out := map[string]string{}
+	for key, value := range tml {
+		out[key] = value
+	}
+	for key, value := range req {
+		out[key] = value
+	}
+	return out
+}
+
+// compile gets the template from the cache or loads and parses it. The
+// language the template is found in is returned.
+func (ap *App) compile(lang, name string) (*compiled, string, error) {
+	key := cacheKey(lang, name)
+
+	if ap.cfg.Cache != nil {
+		if tml, used, ok := ap.cfg.Cache.get(key); ok {
+			return tml, used, nil
+		}
+	}
+
+	body, used, err := ap.load(lang, name)
+	if err != nil {
+		e := validation.Error{
+			Message: ErrLoadTemplate,
+			Params: validation.Params{
+				ParamTemplateLang:  lang,
+				ParamTemplateName:  name,
+				ParamTemplateCause: err.Error(),
+			},
+		}
+
+		return nil, "", ArgumentError{Err: validation.Errors([]error{e})}
+	}
+
+	text, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tml, deps, err := ap.parse(lang, used, cacheKey(used, name), string(text))
+	if err != nil {
+		if _, ok := err.(TemplateError); !ok {
+			err = TemplateError{Err: err}
+		}
+		return nil, "", err
+	}
+
+	if ap.cfg.Cache != nil {
+		ap.cfg.Cache.put(key, used, name, deps, tml)
+	}
+
+	return tml, used, nil
+}
+
+// load loads the template trying the languages of the fallback chain in
+// order. The error of the requested language is returned if the template is
+// not found.
+func (ap *App) load(lang, name string) (io.Reader, string, error) {
+	var first error
+	for _, l := range fallbacks(lang, ap.cfg.Fallback) {
+		body, err := ap.loader.Load(l, name)
+		if err == nil {
+			return body, l, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return nil, "", first
 }
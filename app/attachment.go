@@ -0,0 +1,112 @@
+package app
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/vbogretsov/go-validation"
+
+	"github.com/vbogretsov/sendmail/model"
+)
+
+// ErrLoadAttachment defines error message if an attachment asset not found.
+var ErrLoadAttachment = "cannot load attachment"
+
+// ParamAttachmentRef defines key name for error parameter attachment ref.
+var ParamAttachmentRef = "ref"
+
+// prefixAssets is the prefix of the asset names attachments can refer to.
+// Assets are looked up in the template language fallback chain and then in
+// the shared language "".
+const prefixAssets = "_assets/"
+
+const (
+	dispositionAttachment = "attachment"
+	dispositionInline     = "inline"
+	contentTypeDefault    = "application/octet-stream"
+)
+
+// attach loads the assets the attachments refer to and fills in the
+// defaults, attachments with a content id are inline by default.
+// Attachments with an invalid ref are left as is to be reported by the
+// validation. The encoded assets are kept in loaded by ref unless it is nil.
+func (ap *App) attach(lang string, atts []model.Attachment, loaded map[string]string) error {
+	for n := range atts {
+		att := &atts[n]
+
+		if att.Ref != "" && validRef(att.Ref) {
+			content, ok := loaded[att.Ref]
+			if !ok {
+				data, err := ap.asset(lang, att.Ref)
+				if err != nil {
+					return validation.Errors([]error{validation.Error{
+						Message: ErrLoadAttachment,
+						Params: validation.Params{
+							ParamAttachmentRef: att.Ref,
+							ParamTemplateCause: err.Error(),
+						},
+					}})
+				}
+				content = base64.StdEncoding.EncodeToString(data)
+				if loaded != nil {
+					loaded[att.Ref] = content
+				}
+			}
+			att.Content = content
+			att.Ref = ""
+		}
+
+		if att.ContentType == "" {
+			att.ContentType = contentType(att.Filename)
+		}
+
+		if att.Disposition == "" {
+			att.Disposition = dispositionAttachment
+			if att.ContentID != "" {
+				att.Disposition = dispositionInline
+			}
+		}
+	}
+	return nil
+}
+
+// asset loads the asset trying the languages of the fallback chain and the
+// shared language in order. The error of the requested language is returned
+// if the asset is not found.
+func (ap *App) asset(lang, name string) ([]byte, error) {
+	var first error
+	for _, l := range append(fallbacks(lang, ap.cfg.Fallback), "") {
+		body, err := ap.loader.LoadFile(l, name)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		return ioutil.ReadAll(body)
+	}
+	return nil, first
+}
+
+// validRef reports whether the ref names an asset, refs leaving the assets
+// directory are rejected.
+func validRef(ref string) bool {
+	return strings.HasPrefix(ref, prefixAssets) &&
+		len(ref) > len(prefixAssets) &&
+		path.Clean(ref) == ref
+}
+
+func contentType(name string) string {
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		return ct
+	}
+	return contentTypeDefault
+}
+
+// attachmentSize gets the decoded size of the attachment content.
+func attachmentSize(att model.Attachment) int {
+	return base64.StdEncoding.DecodedLen(len(att.Content))
+}
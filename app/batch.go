@@ -0,0 +1,118 @@
+package app
+
+import (
+	"github.com/vbogretsov/sendmail/model"
+)
+
+// BatchResult represents the outcome of the email of a batch recipient, Err
+// is set if the email is not sent.
+type BatchResult struct {
+	Receipt model.Receipt
+	Err     error
+}
+
+// SendBatch builds an email per recipient of the batch and sends them. The
+// emails are handed to the sender at once if it is a BatchSender. A result
+// per recipient is returned in the same order, the error is set only if the
+// batch itself is invalid. The template, the batch attachments and the
+// assets the template attachments refer to are loaded once.
+func (ap *App) SendBatch(req model.BatchRequest) ([]BatchResult, error) {
+	if err := batchRule(&req); err != nil {
+		return nil, ArgumentError{err}
+	}
+
+	results := make([]BatchResult, len(req.Recipients))
+
+	tml, lang, err := ap.compile(req.TemplateLang, req.TemplateName)
+	if err != nil {
+		for n := range results {
+			results[n].Err = err
+		}
+		return results, nil
+	}
+
+	atts := append([]model.Attachment{}, req.Attachments...)
+	if err := ap.attach(lang, atts, nil); err != nil {
+		return nil, ArgumentError{err}
+	}
+
+	loaded := map[string]string{}
+	msgs := []model.Message{}
+	index := []int{}
+
+	for n, rec := range req.Recipients {
+		r := personalize(req, rec)
+		if err := requestRule(&r); err != nil {
+			results[n].Err = ArgumentError{err}
+			continue
+		}
+
+		// The batch attachments are validated by the batch rule.
+		r.Attachments = atts
+
+		msg, err := ap.build(tml, lang, r, loaded)
+		if err != nil {
+			results[n].Err = err
+			continue
+		}
+
+		msgs = append(msgs, msg)
+		index = append(index, n)
+	}
+
+	ids, errs := Dispatch(ap.sender, msgs)
+	for i, n := range index {
+		if errs[i] != nil {
+			results[n].Err = errs[i]
+			continue
+		}
+		results[n].Receipt = model.Receipt{MessageID: ids[i], Lang: msgs[i].Lang}
+	}
+
+	return results, nil
+}
+
+// Dispatch sends the messages at once if the sender is a BatchSender and one
+// by one otherwise. A message id and an error are returned per message in
+// the same order.
+func Dispatch(sender Sender, msgs []model.Message) ([]string, []error) {
+	if len(msgs) == 0 {
+		return []string{}, []error{}
+	}
+
+	if bs, ok := sender.(BatchSender); ok {
+		return bs.SendBatch(msgs)
+	}
+
+	ids := make([]string, len(msgs))
+	errs := make([]error, len(msgs))
+	for n, msg := range msgs {
+		ids[n], errs[n] = sender.Send(msg)
+	}
+	return ids, errs
+}
+
+// personalize builds the request of the batch recipient, the batch
+// attachments are left out.
+func personalize(req model.BatchRequest, rec model.Recipient) model.Request {
+	args := map[string]interface{}{}
+	for k, v := range req.TemplateArgs {
+		args[k] = v
+	}
+	for k, v := range rec.TemplateArgs {
+		args[k] = v
+	}
+
+	return model.Request{
+		TemplateLang: req.TemplateLang,
+		TemplateName: req.TemplateName,
+		TemplateArgs: args,
+		To:           rec.To,
+		Cc:           rec.Cc,
+		Bcc:          rec.Bcc,
+		ReplyTo:      req.ReplyTo,
+		Headers:      req.Headers,
+		Tags:         req.Tags,
+		Metadata:     mergeMetadata(req.Metadata, rec.Metadata),
+	}
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type cacheItem struct {
+	key     string
+	lang    string
+	name    string
+	deps    []string
+	tml     *compiled
+	expires time.Time
+}
+
+// Cache represents a cache of compiled templates. The least recently used
+// template is evicted once the cache is full, templates older than the TTL
+// are reloaded.
+type Cache struct {
+	mutex sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	order *list.List
+}
+
+// NewCache creates a new cache holding up to size templates, nothing is
+// cached if the size is zero and the size is unbounded if negative.
+// Templates never expire if ttl is zero.
+func NewCache(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:  size,
+		ttl:   ttl,
+		items: map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+// Invalidate removes the template with the language and name provided, the
+// templates of other languages resolved to it are removed as well. If the
+// name is a layout or a partial all templates using it are removed.
+func (c *Cache) Invalidate(lang, name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := cacheKey(lang, name)
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		item := el.Value.(*cacheItem)
+		if item.key == key || (item.lang == lang && item.name == name) || item.uses(name) {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// Purge removes all templates.
+func (c *Cache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// Len gets the number of cached templates.
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.order.Len()
+}
+
+func (item *cacheItem) uses(name string) bool {
+	for _, dep := range item.deps {
+		if dep == name {
+			return true
+		}
+	}
+	return false
+}
+
+// get gets the template and the language it was found in.
+func (c *Cache) get(key string) (*compiled, string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, "", false
+	}
+
+	item := el.Value.(*cacheItem)
+	if c.ttl > 0 && time.Now().After(item.expires) {
+		c.remove(el)
+		return nil, "", false
+	}
+
+	c.order.MoveToFront(el)
+	return item.tml, item.lang, true
+}
+
+// put caches the template requested by key and found in the language
+// provided, deps are the layouts and partials the template uses.
+func (c *Cache) put(key, lang, name string, deps []string, tml *compiled) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	item := &cacheItem{
+		key:     key,
+		lang:    lang,
+		name:    name,
+		deps:    deps,
+		tml:     tml,
+		expires: time.Now().Add(c.ttl),
+	}
+
+	if el, ok := c.items[key]; ok {
+		el.Value = item
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(item)
+
+	if c.size >= 0 && c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*cacheItem).key)
+}
+
+// cacheKey gets the key of the template, the separator cannot appear in
+// languages and names.
+func cacheKey(lang, name string) string {
+	return lang + "/" + name
+}
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"regexp"
+	"strings"
+)
+
+// separator separates the YAML header of a template from the body.
+const separator = "---"
+
+// textSeparator separates an HTML body from its plain text alternative.
+const textSeparator = "--- text"
+
+var bodyBlock = regexp.MustCompile(`^Body:\s*\|([+-]?)\s*$`)
+
+// sections splits the template into the YAML header and the body. The body
+// follows the header after a line consisting of "---":
+//
+//	From:
+//	  Email: noreply@mail.com
+//	Subject: Welcome {{.Username}}
+//	BodyType: text/html
+//	---
+//	<p>Hello {{.Username}}!</p>
+//
+// Templates defining the body as a Body block scalar are split as well. The
+// header keeps the lines of the template and the number of lines preceding
+// the body is returned, so errors can report line numbers of the template.
+// The last result is false if the body cannot be separated, the whole
+// template is a YAML document then and its body cannot be of HTML type as
+// only separated bodies are escaped.
+func sections(text string) (string, string, int, bool) {
+	lines := strings.SplitAfter(text, "\n")
+
+	start := 0
+	for start < len(lines) && strings.TrimSpace(lines[start]) == "" {
+		start++
+	}
+	if start < len(lines) && trim(lines[start]) == separator {
+		start++
+	}
+
+	for n := start; n < len(lines); n++ {
+		if trim(lines[n]) == separator {
+			header := strings.Repeat("\n", start) + strings.Join(lines[start:n], "")
+			return header, strings.Join(lines[n+1:], ""), n + 1, true
+		}
+	}
+
+	return block(lines)
+}
+
+// alternative splits the body into the HTML body and its plain text
+// alternative following a line consisting of "--- text":
+//
+//	<p>Hello {{.Username}}!</p>
+//	--- text
+//	Hello {{.Username}}!
+//
+// The last result is false if the body has no alternative.
+func alternative(body string) (string, string, bool) {
+	lines := strings.SplitAfter(body, "\n")
+	for n, line := range lines {
+		if trim(line) == textSeparator {
+			return strings.Join(lines[:n], ""), strings.Join(lines[n+1:], ""), true
+		}
+	}
+	return body, "", false
+}
+
+// block extracts the Body block scalar from the template lines, the block
+// lines are left blank in the header. The block cannot be extracted if its
+// lines are produced by template actions, e.g. {{include "body" . | indent 2}}.
+func block(lines []string) (string, string, int, bool) {
+	for n, line := range lines {
+		m := bodyBlock.FindStringSubmatch(trim(line))
+		if m == nil {
+			continue
+		}
+
+		end := n + 1
+		for end < len(lines) && (strings.TrimSpace(lines[end]) == "" || indented(lines[end])) {
+			end++
+		}
+
+		if end < len(lines) && strings.HasPrefix(lines[end], "{{") {
+			return "", "", 0, false
+		}
+
+		body, ok := dedent(lines[n+1 : end])
+		if !ok {
+			return "", "", 0, false
+		}
+
+		switch m[1] {
+		case "-":
+			body = strings.TrimRight(body, "\n")
+		case "":
+			body = strings.TrimRight(body, "\n") + "\n"
+		}
+
+		header := strings.Join(lines[:n], "") + strings.Repeat("\n", end-n) + strings.Join(lines[end:], "")
+		return header, body, n + 1, true
+	}
+
+	return "", "", 0, false
+}
+
+// dedent removes the block indentation, the indentation is detected by the
+// first non blank line.
+func dedent(lines []string) (string, bool) {
+	indent := ""
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			indent = line[:len(line)-len(strings.TrimLeft(line, " "))]
+			break
+		}
+	}
+
+	if indent == "" {
+		return "", false
+	}
+
+	body := make([]string, len(lines))
+	for n, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			body[n] = "\n"
+			continue
+		}
+		body[n] = strings.TrimPrefix(line, indent)
+	}
+	return strings.Join(body, ""), true
+}
+
+// pad prefixes the section with a comment spanning the lines preceding it in
+// the template, so errors of the section report line numbers of the template.
+func pad(section string, lines int) string {
+	if lines == 0 {
+		return section
+	}
+	return "{{/*" + strings.Repeat("\n", lines) + "*/}}" + section
+}
+
+func indented(line string) bool {
+	return strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+}
+
+func trim(line string) string {
+	return strings.TrimRight(line, "\r\n")
+}
@@ -0,0 +1,276 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/currency"
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+const (
+	errorInvalidTime   = "invalid time %v"
+	errorInvalidNumber = "invalid number %v"
+	errorInvalidURL    = "unsupported URL scheme %q"
+	errorURLParams     = "URL parameters must be name value pairs"
+	errorPluralForms   = "plural forms must be category text pairs"
+	ellipsis           = "…"
+)
+
+var pluralForms = map[string]plural.Form{
+	"zero":  plural.Zero,
+	"one":   plural.One,
+	"two":   plural.Two,
+	"few":   plural.Few,
+	"many":  plural.Many,
+	"other": plural.Other,
+}
+
+var urlSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+}
+
+// funcs gets the functions available in templates, numbers, currencies,
+// plural forms and title case follow the rules of the language provided:
+//
+//	now                          current time
+//	date layout time [zone]      formats time in the IANA zone, e.g.
+//	                             {{date "02 Jan 2006 15:04" .At "Europe/Moscow"}}
+//	number value [digits]        formats number, e.g. 1,234.5 for en
+//	currency code value          formats ISO 4217 amount, e.g. € 1.234,50 for de
+//	plural n category text ...   selects text by CLDR plural category of n,
+//	                             e.g. {{plural .N "one" "file" "other" "files"}}
+//	upper, lower, title, trim    change case and trim spaces
+//	truncate n text              shortens text to n characters adding …
+//	default fallback value       gets fallback if value is empty
+//	url base [name value ...]    builds http(s) or mailto URL with query
+//	                             parameters escaped
+//
+// Time values are time.Time, RFC 3339 strings or UNIX seconds.
+func funcs(lang string) map[string]interface{} {
+	tag, err := language.Parse(lang)
+	if err != nil {
+		tag = language.Und
+	}
+
+	printer := message.NewPrinter(tag)
+
+	return map[string]interface{}{
+		"now":  time.Now,
+		"date": date,
+		"number": func(value interface{}, digits ...int) (string, error) {
+			return formatNumber(printer, value, digits)
+		},
+		"currency": func(code string, value interface{}) (string, error) {
+			return formatCurrency(printer, code, value)
+		},
+		"plural": func(n interface{}, forms ...string) (string, error) {
+			return pluralize(tag, n, forms)
+		},
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"title": func(s string) string {
+			return cases.Title(tag).String(s)
+		},
+		"trim":     strings.TrimSpace,
+		"truncate": truncate,
+		"default":  fallback,
+		"url":      buildURL,
+	}
+}
+
+func date(layout string, value interface{}, zone ...string) (string, error) {
+	t, err := toTime(value)
+	if err != nil {
+		return "", err
+	}
+
+	if len(zone) > 0 && zone[0] != "" {
+		loc, err := time.LoadLocation(zone[0])
+		if err != nil {
+			return "", err
+		}
+		t = t.In(loc)
+	}
+
+	return t.Format(layout), nil
+}
+
+func toTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return time.Parse(time.RFC3339, v)
+	}
+
+	if f, err := toFloat(value); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf(errorInvalidTime, value)
+}
+
+func toFloat(value interface{}) (float64, error) {
+	if s, ok := value.(string); ok {
+		return strconv.ParseFloat(s, 64)
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	}
+
+	return 0, fmt.Errorf(errorInvalidNumber, value)
+}
+
+func formatNumber(printer *message.Printer, value interface{}, digits []int) (string, error) {
+	f, err := toFloat(value)
+	if err != nil {
+		return "", err
+	}
+
+	if len(digits) > 0 {
+		return printer.Sprint(number.Decimal(f,
+			number.MinFractionDigits(digits[0]),
+			number.MaxFractionDigits(digits[0]))), nil
+	}
+
+	return printer.Sprint(number.Decimal(f)), nil
+}
+
+func formatCurrency(printer *message.Printer, code string, value interface{}) (string, error) {
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := toFloat(value)
+	if err != nil {
+		return "", err
+	}
+
+	return printer.Sprint(currency.Symbol(unit.Amount(f))), nil
+}
+
+func pluralize(tag language.Tag, n interface{}, forms []string) (string, error) {
+	if len(forms)%2 != 0 {
+		return "", errors.New(errorPluralForms)
+	}
+
+	f, err := toFloat(n)
+	if err != nil {
+		return "", err
+	}
+
+	form := plural.Other
+	if f == math.Trunc(f) {
+		form = plural.Cardinal.MatchPlural(tag, int(math.Abs(f)), 0, 0, 0, 0)
+	}
+
+	other := ""
+	for i := 0; i < len(forms); i += 2 {
+		category, ok := pluralForms[forms[i]]
+		if !ok {
+			return "", errors.New(errorPluralForms)
+		}
+		if category == form {
+			return forms[i+1], nil
+		}
+		if category == plural.Other {
+			other = forms[i+1]
+		}
+	}
+
+	return other, nil
+}
+
+func truncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	runes := []rune(s)
+	if n <= 0 {
+		return ""
+	}
+	return string(runes[:n-1]) + ellipsis
+}
+
+// fallback gets the fallback value if the value is empty, e.g. nil, zero or
+// empty string, list or map.
+func fallback(def interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || value[0] == nil {
+		return def
+	}
+
+	v := reflect.ValueOf(value[0])
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if v.Len() == 0 {
+			return def
+		}
+	case reflect.Bool:
+		if !v.Bool() {
+			return def
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Int() == 0 {
+			return def
+		}
+	case reflect.Float32, reflect.Float64:
+		if v.Float() == 0 {
+			return def
+		}
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return def
+		}
+	}
+
+	return value[0]
+}
+
+// buildURL builds URL with query parameters, only http, https and mailto
+// schemes are allowed.
+func buildURL(base string, params ...interface{}) (string, error) {
+	if len(params)%2 != 0 {
+		return "", errors.New(errorURLParams)
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+
+	if !urlSchemes[strings.ToLower(u.Scheme)] {
+		return "", fmt.Errorf(errorInvalidURL, u.Scheme)
+	}
+
+	query := u.Query()
+	for i := 0; i < len(params); i += 2 {
+		query.Add(fmt.Sprint(params[i]), fmt.Sprint(params[i+1]))
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
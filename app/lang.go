@@ -0,0 +1,36 @@
+package app
+
+import (
+	"golang.org/x/text/language"
+)
+
+// fallbacks gets the languages a template is looked up in: the requested
+// language, its canonical BCP 47 form and parents following CLDR
+// inheritance (e.g. pt-BR, pt; es-AR, es-419, es), the base language and
+// finally the fallback language.
+func fallbacks(lang, fallback string) []string {
+	langs := []string{}
+	seen := map[string]bool{}
+
+	add := func(l string) {
+		if l != "" && !seen[l] {
+			seen[l] = true
+			langs = append(langs, l)
+		}
+	}
+
+	add(lang)
+
+	if tag, err := language.Parse(lang); err == nil {
+		for t := tag; !t.IsRoot(); t = t.Parent() {
+			add(t.String())
+		}
+
+		if base, conf := tag.Base(); conf != language.No {
+			add(base.String())
+		}
+	}
+
+	add(fallback)
+	return langs
+}
@@ -0,0 +1,311 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/vbogretsov/go-validation"
+)
+
+// Prefixes of layout and partial template names. Layouts and partials are
+// looked up in the template language fallback chain and then in the shared
+// language "".
+const (
+	prefixLayouts  = "_layouts/"
+	prefixPartials = "_partials/"
+)
+
+const (
+	funcInclude = "include"
+	funcIndent  = "indent"
+	funcCID     = "cid"
+)
+
+const errorInvalidCID = "invalid content id %q"
+
+// shared reports whether the template name refers to a layout or a partial.
+func shared(name string) bool {
+	return strings.HasPrefix(name, prefixLayouts) || strings.HasPrefix(name, prefixPartials)
+}
+
+// helpers gets functions available in text templates. The include function
+// executes the named template of the set and returns its output, so it can
+// be piped to indent within YAML block scalars. The cid function gets the
+// URL of an inline image.
+func helpers(set *template.Template, lang string) template.FuncMap {
+	fm := template.FuncMap(funcs(lang))
+	fm[funcInclude] = func(name string, data interface{}) (string, error) {
+		buf := new(bytes.Buffer)
+		if err := set.ExecuteTemplate(buf, name, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	fm[funcIndent] = indent
+	fm[funcCID] = cid
+	return fm
+}
+
+// htmlHelpers gets functions available in HTML templates. The output of
+// include is already escaped, so it is not escaped again. The cid URLs are
+// trusted as html/template rejects URLs with schemes other than http, https
+// and mailto.
+func htmlHelpers(set *htmltemplate.Template, lang string) htmltemplate.FuncMap {
+	fm := htmltemplate.FuncMap(funcs(lang))
+	fm[funcInclude] = func(name string, data interface{}) (htmltemplate.HTML, error) {
+		buf := new(bytes.Buffer)
+		if err := set.ExecuteTemplate(buf, name, data); err != nil {
+			return "", err
+		}
+		return htmltemplate.HTML(buf.String()), nil
+	}
+	fm[funcIndent] = indent
+	fm[funcCID] = func(id string) (htmltemplate.URL, error) {
+		url, err := cid(id)
+		return htmltemplate.URL(url), err
+	}
+	return fm
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+func cid(id string) (string, error) {
+	if !contentIDPattern.MatchString(id) {
+		return "", fmt.Errorf(errorInvalidCID, id)
+	}
+	return "cid:" + id, nil
+}
+
+// compiled represents a parsed template. The body is parsed both as text and
+// HTML template as the body type is known only once the header is rendered.
+// The body templates are nil if the template is a single YAML document, alt
+// is the plain text alternative of the body if any.
+type compiled struct {
+	header *template.Template
+	text   *template.Template
+	html   *htmltemplate.Template
+	alt    *template.Template
+}
+
+// parse parses the template sections together with the layouts and partials
+// they refer to. Layouts and partials are parsed first, so the template can
+// redefine their blocks. They are looked up from the requested language,
+// the functions follow the language the template is found in. Names of the
+// layouts and partials are returned.
+func (ap *App) parse(lang, used, key, text string) (*compiled, []string, error) {
+	header, body, line, split := sections(text)
+	if !split {
+		header = text
+	}
+
+	names, texts, err := ap.partials(lang, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tml := &compiled{}
+
+	tml.header, err = textSet(used, key, header, names, texts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !split {
+		return tml, names, nil
+	}
+
+	body, alt, hasAlt := alternative(body)
+	padded := pad(body, line)
+
+	bnames, btexts, err := ap.partials(lang, padded)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tml.text, err = textSet(used, key, padded, bnames, btexts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tml.html, err = htmlSet(used, key, padded, bnames, btexts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names = append(names, bnames...)
+	if !hasAlt {
+		return tml, names, nil
+	}
+
+	alt = pad(alt, line+strings.Count(body, "\n")+1)
+
+	anames, atexts, err := ap.partials(lang, alt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tml.alt, err = textSet(used, key, alt, anames, atexts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tml, append(names, anames...), nil
+}
+
+func textSet(lang, key, text string, names, texts []string) (*template.Template, error) {
+	set := template.New(key)
+	set.Funcs(helpers(set, lang))
+
+	for n, name := range names {
+		if _, err := set.New(name).Parse(texts[n]); err != nil {
+			return nil, err
+		}
+	}
+
+	return set.Parse(text)
+}
+
+func htmlSet(lang, key, text string, names, texts []string) (*htmltemplate.Template, error) {
+	set := htmltemplate.New(key)
+	set.Funcs(htmlHelpers(set, lang))
+
+	for n, name := range names {
+		if _, err := set.New(name).Parse(texts[n]); err != nil {
+			return nil, err
+		}
+	}
+
+	return set.Parse(text)
+}
+
+// partials loads the layouts and partials the template refers to,
+// dependencies go first.
+func (ap *App) partials(lang, text string) ([]string, []string, error) {
+	names := []string{}
+	texts := []string{}
+	seen := map[string]bool{}
+
+	var visit func(text string) error
+	visit = func(text string) error {
+		refs, err := references(text)
+		if err != nil {
+			return err
+		}
+
+		for _, ref := range refs {
+			if seen[ref] || !shared(ref) {
+				continue
+			}
+			seen[ref] = true
+
+			data, err := ap.loadShared(lang, ref)
+			if err != nil {
+				return err
+			}
+
+			if err := visit(data); err != nil {
+				return err
+			}
+
+			names = append(names, ref)
+			texts = append(texts, data)
+		}
+
+		return nil
+	}
+
+	if err := visit(text); err != nil {
+		return nil, nil, err
+	}
+	return names, texts, nil
+}
+
+func (ap *App) loadShared(lang, name string) (string, error) {
+	data, err := ap.asset(lang, name)
+	if err != nil {
+		e := validation.Error{
+			Message: ErrLoadTemplate,
+			Params: validation.Params{
+				ParamTemplateLang:  lang,
+				ParamTemplateName:  name,
+				ParamTemplateCause: err.Error(),
+			},
+		}
+		return "", TemplateError{Err: validation.Errors([]error{e})}
+	}
+	return string(data), nil
+}
+
+// references gets names of the templates referred by template actions and
+// include calls.
+func references(text string) ([]string, error) {
+	set := template.New("")
+	set.Funcs(helpers(set, ""))
+
+	if _, err := set.Parse(text); err != nil {
+		return nil, err
+	}
+
+	refs := []string{}
+	for _, t := range set.Templates() {
+		if t.Tree != nil {
+			refs = walk(t.Tree.Root, refs)
+		}
+	}
+	return refs, nil
+}
+
+func walk(node parse.Node, refs []string) []string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return refs
+		}
+		for _, c := range n.Nodes {
+			refs = walk(c, refs)
+		}
+	case *parse.TemplateNode:
+		refs = append(refs, n.Name)
+		refs = walk(n.Pipe, refs)
+	case *parse.ActionNode:
+		refs = walk(n.Pipe, refs)
+	case *parse.PipeNode:
+		if n == nil {
+			return refs
+		}
+		for _, c := range n.Cmds {
+			refs = walk(c, refs)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) > 1 {
+			id, ok := n.Args[0].(*parse.IdentifierNode)
+			str, isstr := n.Args[1].(*parse.StringNode)
+			if ok && isstr && id.Ident == funcInclude {
+				refs = append(refs, str.Text)
+			}
+		}
+		for _, c := range n.Args {
+			refs = walk(c, refs)
+		}
+	case *parse.IfNode:
+		refs = walkBranch(&n.BranchNode, refs)
+	case *parse.RangeNode:
+		refs = walkBranch(&n.BranchNode, refs)
+	case *parse.WithNode:
+		refs = walkBranch(&n.BranchNode, refs)
+	}
+	return refs
+}
+
+func walkBranch(n *parse.BranchNode, refs []string) []string {
+	refs = walk(n.Pipe, refs)
+	refs = walk(n.List, refs)
+	return walk(n.ElseList, refs)
+}
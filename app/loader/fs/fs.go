@@ -1,33 +1,133 @@
 package fs
 
 import (
-	"bufio"
-	"fmt"
+	"bytes"
 	"io"
-	"os"
+	"io/ioutil"
+	"net/url"
 	"path"
+	"strconv"
+	"strings"
 
 	"github.com/vbogretsov/sendmail/app"
 )
 
+const ext = ".msg"
+
+const (
+	optionWatch    = "watch"
+	optionValidate = "validate"
+)
+
 type fsloader struct {
 	root string
 }
 
 // New creates a new loader. The exact loader type is determined by root prefix.
+// The root may contain options as a query string, watch=true reloads
+// templates changed on disk and validate=true keeps serving the last good
+// version of a watched template if the new one cannot be parsed.
 func New(root string) (app.Loader, error) {
-	return fsloader{root: root}, nil
+	opts := url.Values{}
+	if n := strings.Index(root, "?"); n != -1 {
+		q, err := url.ParseQuery(root[n+1:])
+		if err != nil {
+			return nil, err
+		}
+		root, opts = root[:n], q
+	}
+
+	watch, err := option(opts, optionWatch)
+	if err != nil {
+		return nil, err
+	}
+
+	validate, err := option(opts, optionValidate)
+	if err != nil {
+		return nil, err
+	}
+
+	ld := fsloader{root: root}
+	if !watch {
+		return ld, nil
+	}
+
+	return newWatcher(ld, validate)
+}
+
+func option(opts url.Values, name string) (bool, error) {
+	value := opts.Get(name)
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// fname gets the path of the template file, templates have the .msg
+// extension.
+func (ld fsloader) fname(lang, name string) string {
+	return ld.fpath(lang, name+ext)
+}
+
+// fpath gets the path of a file the templates refer to, e.g.
+// _layouts/base.html, the shared ones are stored in the root.
+func (ld fsloader) fpath(lang, file string) string {
+	return path.Join(ld.root, lang, file)
 }
 
 // Load loads a template with the language and name provided from the local
 // file system.
 func (ld fsloader) Load(lang, name string) (io.Reader, error) {
-	fname := path.Join(ld.root, lang, fmt.Sprintf("%s.msg", name))
+	return readAll(ld.fname(lang, name))
+}
 
-	file, err := os.Open(fname)
+// LoadFile loads a layout, partial or asset with the language and file name
+// provided from the local file system.
+func (ld fsloader) LoadFile(lang, file string) (io.Reader, error) {
+	return readAll(ld.fpath(lang, file))
+}
+
+// readAll reads the whole file, so it is closed once loaded.
+func readAll(fname string) (io.Reader, error) {
+	data, err := ioutil.ReadFile(fname)
 	if err != nil {
 		return nil, err
 	}
+	return bytes.NewReader(data), nil
+}
+
+// List gets all templates found under the root, each subdirectory of the root
+// is a language containing templates with the .msg extension. Directories
+// starting with underscore contain layouts and partials and are skipped.
+func (ld fsloader) List() ([]app.Entry, error) {
+	langs, err := ioutil.ReadDir(ld.root)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []app.Entry{}
+	for _, lang := range langs {
+		if !lang.IsDir() || strings.HasPrefix(lang.Name(), "_") {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(path.Join(ld.root, lang.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if file.IsDir() || path.Ext(file.Name()) != ext {
+				continue
+			}
+
+			entries = append(entries, app.Entry{
+				Lang:   lang.Name(),
+				Name:   strings.TrimSuffix(file.Name(), ext),
+				Source: ld.fname(lang.Name(), strings.TrimSuffix(file.Name(), ext)),
+			})
+		}
+	}
 
-	return bufio.NewReader(file), nil
+	return entries, nil
 }
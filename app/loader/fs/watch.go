@@ -0,0 +1,325 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template/parse"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+const errorEmptyTemplate = "template is empty"
+
+// assets is the directory of files referred by templates, e.g. images and
+// attachments, they are not parsed.
+const assets = "_assets"
+
+// watcher is a file system loader keeping templates in memory and reloading
+// them once changed on disk.
+type watcher struct {
+	fsloader
+	validate bool
+	fw       *fsnotify.Watcher
+	mutex    sync.RWMutex
+	content  map[string][]byte
+	notify   []func(lang, name string)
+}
+
+func newWatcher(ld fsloader, validate bool) (*watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	self := &watcher{
+		fsloader: ld,
+		validate: validate,
+		fw:       fw,
+		content:  map[string][]byte{},
+	}
+
+	if err := self.addAll(ld.root, false); err != nil {
+		fw.Close()
+		return nil, err
+	}
+
+	go self.run()
+	return self, nil
+}
+
+// Load loads a template with the language and name provided, the template
+// is read from disk on the first load only. If validation is enabled an
+// invalid template is not loaded.
+func (self *watcher) Load(lang, name string) (io.Reader, error) {
+	return self.read(path.Join(lang, name+ext))
+}
+
+// LoadFile loads a layout, partial or asset with the language and file name
+// provided, the file is read from disk on the first load only.
+func (self *watcher) LoadFile(lang, file string) (io.Reader, error) {
+	return self.read(path.Join(lang, file))
+}
+
+// read gets the file with the path relative to the root from memory or
+// reads it from disk.
+func (self *watcher) read(key string) (io.Reader, error) {
+	self.mutex.RLock()
+	text, ok := self.content[key]
+	self.mutex.RUnlock()
+
+	if ok {
+		return bytes.NewReader(text), nil
+	}
+
+	text, err := ioutil.ReadFile(path.Join(self.root, key))
+	if err != nil {
+		return nil, err
+	}
+
+	if self.validate {
+		if err := check(key, text); err != nil {
+			return nil, err
+		}
+	}
+
+	self.mutex.Lock()
+	if _, ok := self.content[key]; !ok {
+		self.content[key] = text
+	}
+	self.mutex.Unlock()
+
+	return bytes.NewReader(text), nil
+}
+
+// relpath gets the path relative to the root of the changed template or
+// file, names of layouts, partials and assets start with underscore.
+func relpath(lang, name string) string {
+	if strings.HasPrefix(name, "_") {
+		return path.Join(lang, name)
+	}
+	return path.Join(lang, name+ext)
+}
+
+// Notify registers a function called with the language and name of each
+// changed template.
+func (self *watcher) Notify(fn func(lang, name string)) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.notify = append(self.notify, fn)
+}
+
+// Close stops watching the root directory.
+func (self *watcher) Close() error {
+	return self.fw.Close()
+}
+
+func (self *watcher) add(dir string) error {
+	if err := self.fw.Add(dir); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"path": dir,
+	}).Debug("watching templates")
+	return nil
+}
+
+// addAll watches the directory and all its subdirectories. If scan is set
+// templates found are reloaded, they could be written before the directory
+// is watched.
+func (self *watcher) addAll(dir string, scan bool) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return self.add(p)
+		}
+
+		if lang, name, ok := self.template(p); ok && scan {
+			self.reload(lang, name)
+		}
+		return nil
+	})
+}
+
+func (self *watcher) run() {
+	for {
+		select {
+		case ev, ok := <-self.fw.Events:
+			if !ok {
+				return
+			}
+			self.handle(ev)
+		case err, ok := <-self.fw.Errors:
+			if !ok {
+				return
+			}
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("unable to watch templates")
+		}
+	}
+}
+
+func (self *watcher) handle(ev fsnotify.Event) {
+	if ev.Op&fsnotify.Create != 0 {
+		if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+			if err := self.addAll(ev.Name, true); err != nil {
+				log.WithFields(log.Fields{
+					"path":  ev.Name,
+					"error": err,
+				}).Error("unable to watch templates")
+			}
+			return
+		}
+	}
+
+	lang, name, ok := self.template(ev.Name)
+	if !ok {
+		return
+	}
+
+	switch {
+	case ev.Op&(fsnotify.Write|fsnotify.Create) != 0:
+		self.reload(lang, name)
+	case ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		self.forget(lang, name)
+	}
+}
+
+// template gets the language and the name of the template stored in the file.
+// Templates are stored as <lang>/<name>.msg, layouts and partials are stored
+// as [<lang>/]_<dir>/<name>.<ext>.
+func (self *watcher) template(fname string) (string, string, bool) {
+	rel, err := filepath.Rel(self.root, fname)
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+
+	lang := ""
+	if !strings.HasPrefix(parts[0], "_") {
+		lang, parts = parts[0], parts[1:]
+	}
+
+	if len(parts) == 0 {
+		return "", "", false
+	}
+
+	name := strings.Join(parts, "/")
+	switch {
+	case strings.HasPrefix(name, "_"):
+		return lang, name, true
+	case len(parts) == 1 && path.Ext(name) == ext:
+		return lang, strings.TrimSuffix(name, ext), true
+	}
+	return "", "", false
+}
+
+// reload reads the changed template, if validation is enabled an invalid
+// template is ignored and the last good version is kept. Otherwise only an
+// empty template is ignored, editors often truncate a file before writing
+// the new content.
+func (self *watcher) reload(lang, name string) {
+	key := relpath(lang, name)
+	fname := path.Join(self.root, key)
+
+	text, err := ioutil.ReadFile(fname)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  fname,
+			"error": err,
+		}).Error("unable to reload template")
+		return
+	}
+
+	if self.validate {
+		if err := check(key, text); err != nil {
+			log.WithFields(log.Fields{
+				"path":  fname,
+				"error": err,
+			}).Error("invalid template, keeping last good version")
+			return
+		}
+	} else if len(bytes.TrimSpace(text)) == 0 {
+		log.WithFields(log.Fields{
+			"path": fname,
+		}).Debug("empty template, keeping last version")
+		return
+	}
+
+	self.mutex.Lock()
+	self.content[key] = text
+	self.mutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"path": fname,
+	}).Info("template reloaded")
+
+	self.changed(lang, name)
+}
+
+// forget drops the removed template. If validation is enabled the last good
+// version is kept until a valid replacement appears, editors often save
+// files by renaming.
+func (self *watcher) forget(lang, name string) {
+	if self.validate {
+		return
+	}
+
+	self.mutex.Lock()
+	delete(self.content, relpath(lang, name))
+	self.mutex.Unlock()
+
+	self.changed(lang, name)
+}
+
+func (self *watcher) changed(lang, name string) {
+	self.mutex.RLock()
+	notify := self.notify
+	self.mutex.RUnlock()
+
+	for _, fn := range notify {
+		fn(lang, name)
+	}
+}
+
+// check reports an error if the template is empty or cannot be parsed,
+// editors often truncate a file before writing the new content. Functions
+// are not checked as they are provided by the app. Assets are only checked
+// to be non-empty.
+func check(key string, text []byte) error {
+	if len(bytes.TrimSpace(text)) == 0 {
+		return errors.New(errorEmptyTemplate)
+	}
+
+	if asset(key) {
+		return nil
+	}
+
+	tree := parse.New(key)
+	tree.Mode = parse.SkipFuncCheck
+	_, err := tree.Parse(string(text), "", "", map[string]*parse.Tree{})
+	return err
+}
+
+func asset(key string) bool {
+	for _, part := range strings.Split(key, "/") {
+		if part == assets {
+			return true
+		}
+	}
+	return false
+}
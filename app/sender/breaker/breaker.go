@@ -0,0 +1,184 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+)
+
+// State represents a circuit breaker state.
+type State int
+
+const (
+	// Closed means requests pass through to the provider.
+	Closed State = iota
+	// Open means requests fail fast without calling the provider.
+	Open
+	// HalfOpen means a single probe request is let through to check whether
+	// the provider recovered.
+	HalfOpen
+)
+
+var stateNames = map[State]string{
+	Closed:   "closed",
+	Open:     "open",
+	HalfOpen: "half-open",
+}
+
+// String gets string representation of a circuit breaker state.
+func (s State) String() string {
+	return stateNames[s]
+}
+
+// OpenError represents an error returned while the circuit is open.
+type OpenError struct {
+	After time.Duration
+}
+
+// Error gets string representation of an open circuit error.
+func (e OpenError) Error() string {
+	return "circuit breaker is open"
+}
+
+// Temporary reports whether the error is temporary.
+func (e OpenError) Temporary() bool {
+	return true
+}
+
+// RetryAfter gets the time left until the circuit lets a probe through.
+func (e OpenError) RetryAfter() time.Duration {
+	return e.After
+}
+
+// Sender represents a sender guarded by a circuit breaker. After threshold
+// consecutive transient failures the circuit opens and emails fail fast for
+// the timeout period, then a single probe is let through.
+type Sender struct {
+	mutex     sync.Mutex
+	sender    app.Sender
+	threshold int
+	timeout   time.Duration
+	state     State
+	failures  int
+	opened    time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+// New creates a new circuit breaker sender.
+func New(sender app.Sender, threshold int, timeout time.Duration) *Sender {
+	return &Sender{
+		sender:    sender,
+		threshold: threshold,
+		timeout:   timeout,
+		now:       time.Now,
+	}
+}
+
+// Send sends an email if the circuit is not open.
+func (s *Sender) Send(msg model.Message) (string, error) {
+	if err := s.acquire(); err != nil {
+		return "", err
+	}
+
+	id, err := s.sender.Send(msg)
+	s.release(err)
+	return id, err
+}
+
+// SendBatch sends the emails if the circuit is not open. The batch counts as
+// a single failure if any email failed with a transient error.
+func (s *Sender) SendBatch(msgs []model.Message) ([]string, []error) {
+	if err := s.acquire(); err != nil {
+		errs := make([]error, len(msgs))
+		for n := range errs {
+			errs[n] = err
+		}
+		return make([]string, len(msgs)), errs
+	}
+
+	ids, errs := app.Dispatch(s.sender, msgs)
+
+	var failure error
+	for _, err := range errs {
+		if err != nil && app.IsTransient(err) {
+			failure = err
+			break
+		}
+	}
+
+	s.release(failure)
+	return ids, errs
+}
+
+// State gets the current circuit breaker state.
+func (s *Sender) State() State {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state == Open && !s.now().Before(s.opened.Add(s.timeout)) {
+		return HalfOpen
+	}
+	return s.state
+}
+
+func (s *Sender) acquire() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch s.state {
+	case Open:
+		left := s.opened.Add(s.timeout).Sub(s.now())
+		if left > 0 {
+			return OpenError{After: left}
+		}
+		s.transit(HalfOpen)
+		s.probing = true
+	case HalfOpen:
+		if s.probing {
+			return OpenError{After: s.timeout}
+		}
+		s.probing = true
+	}
+
+	return nil
+}
+
+func (s *Sender) release(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.probing = false
+
+	if err != nil && app.IsTransient(err) {
+		s.failures++
+		if s.state == HalfOpen || s.failures >= s.threshold {
+			s.opened = s.now()
+			s.transit(Open)
+		}
+		return
+	}
+
+	s.failures = 0
+	if s.state != Closed {
+		s.transit(Closed)
+	}
+}
+
+func (s *Sender) transit(state State) {
+	if s.state == state {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"from":     s.state.String(),
+		"to":       state.String(),
+		"failures": s.failures,
+	}).Warn("circuit breaker state changed")
+
+	s.state = state
+}
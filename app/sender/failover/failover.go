@@ -0,0 +1,209 @@
+package failover
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+)
+
+const errorUnavailable = "all providers are unavailable"
+
+// Provider represents a named sender participating in a failover chain.
+type Provider struct {
+	Name   string
+	Sender app.Sender
+}
+
+// Error represents an error returned when no provider could send an email.
+type Error struct {
+	Errs map[string]error
+}
+
+// Error gets string representation of a failover error, provider errors
+// are sorted by provider name.
+func (e Error) Error() string {
+	if len(e.Errs) == 0 {
+		return errorUnavailable
+	}
+
+	names := make([]string, 0, len(e.Errs))
+	for name := range e.Errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for n, name := range names {
+		msgs[n] = fmt.Sprintf("%s: %v", name, e.Errs[name])
+	}
+	return fmt.Sprintf("%s (%s)", errorUnavailable, strings.Join(msgs, "; "))
+}
+
+// Temporary reports whether the error is temporary, the chain may succeed
+// once a provider recovers.
+func (e Error) Temporary() bool {
+	return true
+}
+
+type provider struct {
+	Provider
+	until time.Time
+}
+
+// Sender represents an ordered chain of providers. An email is sent via the
+// first healthy provider, on a transient error the next one is tried and the
+// failed provider is skipped for a cool-down period.
+type Sender struct {
+	mutex     sync.Mutex
+	providers []*provider
+	cooldown  time.Duration
+	now       func() time.Time
+}
+
+// New creates a new failover sender.
+func New(providers []Provider, cooldown time.Duration) *Sender {
+	s := Sender{
+		providers: make([]*provider, len(providers)),
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+	for i, p := range providers {
+		s.providers[i] = &provider{Provider: p}
+	}
+	return &s
+}
+
+// Send sends an email via the first healthy provider.
+func (s *Sender) Send(msg model.Message) (string, error) {
+	errs := map[string]error{}
+
+	for _, p := range s.providers {
+		if !s.available(p) {
+			continue
+		}
+
+		id, err := p.Sender.Send(msg)
+		if err == nil {
+			s.succeeded(p)
+			return id, nil
+		}
+
+		if !app.IsTransient(err) {
+			return "", err
+		}
+
+		s.failed(p, err)
+		errs[p.Name] = err
+	}
+
+	return "", Error{Errs: errs}
+}
+
+// SendBatch sends the emails via the first healthy provider, the emails
+// failed with transient errors are sent via the next one.
+func (s *Sender) SendBatch(msgs []model.Message) ([]string, []error) {
+	ids := make([]string, len(msgs))
+	errs := make([]error, len(msgs))
+	failures := make([]map[string]error, len(msgs))
+
+	pending := make([]int, len(msgs))
+	for n := range msgs {
+		pending[n] = n
+		failures[n] = map[string]error{}
+	}
+
+	for _, p := range s.providers {
+		if len(pending) == 0 {
+			break
+		}
+
+		if !s.available(p) {
+			continue
+		}
+
+		batch := make([]model.Message, len(pending))
+		for i, n := range pending {
+			batch[i] = msgs[n]
+		}
+
+		pids, perrs := app.Dispatch(p.Sender, batch)
+
+		left := []int{}
+		var failure error
+		for i, n := range pending {
+			switch err := perrs[i]; {
+			case err == nil:
+				ids[n] = pids[i]
+			case !app.IsTransient(err):
+				errs[n] = err
+			default:
+				failures[n][p.Name] = err
+				left = append(left, n)
+				failure = err
+			}
+		}
+
+		if failure != nil {
+			s.failed(p, failure)
+		} else {
+			s.succeeded(p)
+		}
+
+		pending = left
+	}
+
+	for _, n := range pending {
+		errs[n] = Error{Errs: failures[n]}
+	}
+
+	return ids, errs
+}
+
+// Healthy gets the names of providers which are not in a cool-down period.
+func (s *Sender) Healthy() []string {
+	names := []string{}
+	for _, p := range s.providers {
+		if s.available(p) {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+func (s *Sender) available(p *provider) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.now().Before(p.until)
+}
+
+func (s *Sender) succeeded(p *provider) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !p.until.IsZero() {
+		p.until = time.Time{}
+		log.WithFields(log.Fields{
+			"provider": p.Name,
+		}).Info("provider recovered")
+	}
+}
+
+func (s *Sender) failed(p *provider, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p.until = s.now().Add(s.cooldown)
+
+	log.WithFields(log.Fields{
+		"provider": p.Name,
+		"error":    err,
+		"cooldown": s.cooldown.String(),
+	}).Warn("provider failed, falling over")
+}
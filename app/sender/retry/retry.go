@@ -0,0 +1,144 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+)
+
+// Config represents retry parameters.
+type Config struct {
+	// Attempts is the maximum number of send attempts including the first one.
+	Attempts int
+	// Delay is the delay before the first retry, it doubles on each attempt.
+	Delay time.Duration
+	// MaxDelay limits the delay between attempts.
+	MaxDelay time.Duration
+}
+
+// maxDelay is the longest delay representable by time.Duration.
+const maxDelay = time.Duration(math.MaxInt64)
+
+type retryAfter interface {
+	RetryAfter() time.Duration
+}
+
+// Sender represents a sender retrying transient failures with exponential
+// backoff and jitter.
+type Sender struct {
+	sender app.Sender
+	cfg    Config
+	sleep  func(time.Duration)
+}
+
+// New creates a new retrying sender.
+func New(sender app.Sender, cfg Config) *Sender {
+	return &Sender{sender: sender, cfg: cfg, sleep: time.Sleep}
+}
+
+// Send sends an email retrying on transient errors until the attempts budget
+// is exhausted.
+func (s *Sender) Send(msg model.Message) (string, error) {
+	for attempt := 1; ; attempt++ {
+		id, err := s.sender.Send(msg)
+		if err == nil {
+			return id, nil
+		}
+
+		if !app.IsTransient(err) || attempt >= s.cfg.Attempts {
+			return "", err
+		}
+
+		delay := s.backoff(attempt, err)
+
+		log.WithFields(log.Fields{
+			"attempt": attempt,
+			"delay":   delay.String(),
+			"error":   err,
+		}).Warn("send failed, retrying")
+
+		s.sleep(delay)
+	}
+}
+
+// SendBatch sends the emails retrying the ones failed with transient errors
+// until the attempts budget is exhausted, sent emails are not sent again.
+func (s *Sender) SendBatch(msgs []model.Message) ([]string, []error) {
+	ids, errs := app.Dispatch(s.sender, msgs)
+
+	for attempt := 1; attempt < s.cfg.Attempts; attempt++ {
+		index := []int{}
+		failed := []error{}
+		for n, err := range errs {
+			if err != nil && app.IsTransient(err) {
+				index = append(index, n)
+				failed = append(failed, err)
+			}
+		}
+
+		if len(index) == 0 {
+			break
+		}
+
+		delay := s.backoff(attempt, failed...)
+
+		log.WithFields(log.Fields{
+			"attempt": attempt,
+			"delay":   delay.String(),
+			"failed":  len(index),
+		}).Warn("batch send failed, retrying")
+
+		s.sleep(delay)
+
+		retry := make([]model.Message, len(index))
+		for i, n := range index {
+			retry[i] = msgs[n]
+		}
+
+		rids, rerrs := app.Dispatch(s.sender, retry)
+		for i, n := range index {
+			ids[n], errs[n] = rids[i], rerrs[i]
+		}
+	}
+
+	return ids, errs
+}
+
+// backoff gets the delay before the next attempt. The delay grows
+// exponentially up to MaxDelay, a random jitter of up to a half of the
+// delay is applied to spread retries of concurrent senders. The delay is
+// not shorter than the one requested by the errors, e.g. by rate limits.
+func (s *Sender) backoff(attempt int, errs ...error) time.Duration {
+	delay := s.cfg.Delay
+	for i := 1; i < attempt; i++ {
+		if delay > maxDelay/2 {
+			delay = maxDelay
+			break
+		}
+		delay *= 2
+		if s.cfg.MaxDelay > 0 && delay >= s.cfg.MaxDelay {
+			break
+		}
+	}
+
+	if s.cfg.MaxDelay > 0 && delay > s.cfg.MaxDelay {
+		delay = s.cfg.MaxDelay
+	}
+
+	if half := int64(delay / 2); half > 0 {
+		delay = time.Duration(half + rand.Int63n(half+1))
+	}
+
+	for _, err := range errs {
+		if ra, ok := err.(retryAfter); ok && ra.RetryAfter() > delay {
+			delay = ra.RetryAfter()
+		}
+	}
+
+	return delay
+}
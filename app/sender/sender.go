@@ -1,16 +1,28 @@
 package sender
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/app/sender/failover"
 	"github.com/vbogretsov/sendmail/app/sender/sendgrid"
+	"github.com/vbogretsov/sendmail/app/sender/smtp"
 )
 
 type factory func(url, key string) (app.Sender, error)
 
 var senders = map[string]factory{
 	"sendgrid": sendgrid.New,
+	"smtp":     smtp.New,
+}
+
+// Config represents a provider configuration.
+type Config struct {
+	Name string
+	URL  string
+	Key  string
 }
 
 // New creates a new sender.
@@ -22,6 +34,33 @@ func New(name, url, key string) (app.Sender, error) {
 	return fn(url, key)
 }
 
+// NewFailover creates a new sender which tries the providers configured in
+// order and falls over to the next one on a transient error. A failed
+// provider is skipped for the cooldown period.
+func NewFailover(configs []Config, cooldown time.Duration) (app.Sender, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("no providers configured")
+	}
+
+	if len(configs) == 1 {
+		return New(configs[0].Name, configs[0].URL, configs[0].Key)
+	}
+
+	providers := make([]failover.Provider, len(configs))
+	for i, cfg := range configs {
+		sr, err := New(cfg.Name, cfg.URL, cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		providers[i] = failover.Provider{
+			Name:   fmt.Sprintf("%s[%d]", cfg.Name, i),
+			Sender: sr,
+		}
+	}
+
+	return failover.New(providers, cooldown), nil
+}
+
 // Providers gets lost of available providers.
 func Providers() []string {
 	providers := []string{}
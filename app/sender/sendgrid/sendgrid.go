@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/sendgrid/rest"
 	api "github.com/sendgrid/sendgrid-go"
 	log "github.com/sirupsen/logrus"
 
@@ -14,22 +17,47 @@ import (
 
 const v3URL = "/v3/mail/send"
 
+const (
+	headerMessageID      = "X-Message-Id"
+	headerRetryAfter     = "Retry-After"
+	headerRateLimitReset = "X-RateLimit-Reset"
+	defaultRetryAfter    = time.Second
+	maxPersonalizations  = 1000
+)
+
 type content struct {
 	Type  string `json:"type"`
 	Value string `json:"value"`
 }
 
+type attachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type,omitempty"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
 type personalization struct {
-	Subject string          `json:"subject"`
-	To      []model.Address `json:"to"`
-	Cc      []model.Address `json:"cc,omitempty"`
-	Bcc     []model.Address `json:"bcc,omitempty"`
+	To         []model.Address   `json:"to,omitempty"`
+	Cc         []model.Address   `json:"cc,omitempty"`
+	Bcc        []model.Address   `json:"bcc,omitempty"`
+	Subject    string            `json:"subject,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	CustomArgs map[string]string `json:"custom_args,omitempty"`
 }
 
 type message struct {
-	From            model.Address   `json:"from"`
-	Personalization personalization `json:"personalization"`
-	Content         content         `json:"content"`
+	Personalizations []personalization `json:"personalizations"`
+	From             model.Address     `json:"from"`
+	ReplyTo          *model.Address    `json:"reply_to,omitempty"`
+	ReplyToList      []model.Address   `json:"reply_to_list,omitempty"`
+	Subject          string            `json:"subject"`
+	Content          []content         `json:"content"`
+	Attachments      []attachment      `json:"attachments,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"`
+	Categories       []string          `json:"categories,omitempty"`
+	CustomArgs       map[string]string `json:"custom_args,omitempty"`
 }
 
 // Sender represents a SendGrid sender.
@@ -47,25 +75,69 @@ func New(url, key string) (app.Sender, error) {
 	return &s, nil
 }
 
-// Send sends an email via SendGrid API.
-func (s *Sender) Send(msg model.Message) error {
-	data := message{
-		From: msg.From,
-		Personalization: personalization{
-			Subject: msg.Subject,
-			To:      msg.To,
-			Cc:      msg.Cc,
-			Bcc:     msg.Bcc,
-		},
-		Content: content{
-			Type:  msg.BodyType,
-			Value: msg.Body,
+// Send sends an email via SendGrid API. The X-Message-Id response header is
+// returned as the message id.
+func (s *Sender) Send(msg model.Message) (string, error) {
+	data := payload(msg)
+	data.Personalizations = []personalization{
+		{
+			To:  msg.To,
+			Cc:  msg.Cc,
+			Bcc: msg.Bcc,
 		},
 	}
 
+	return s.post(data)
+}
+
+// SendBatch sends the emails via SendGrid API. Emails differing only in
+// recipients, subject, headers and metadata are sent in a single call as
+// personalizations of the same message, up to maxPersonalizations per call.
+// Emails with different bodies are sent in separate calls. Emails sent in
+// the same call share the message id.
+func (s *Sender) SendBatch(msgs []model.Message) ([]string, []error) {
+	ids := make([]string, len(msgs))
+	errs := make([]error, len(msgs))
+
+	for _, group := range groups(msgs) {
+		for len(group) > 0 {
+			n := maxPersonalizations
+			if n > len(group) {
+				n = len(group)
+			}
+			chunk := group[:n]
+			group = group[n:]
+
+			data := payload(msgs[chunk[0]])
+			data.Headers = nil
+			data.CustomArgs = nil
+
+			for _, i := range chunk {
+				msg := msgs[i]
+				data.Personalizations = append(data.Personalizations, personalization{
+					To:         msg.To,
+					Cc:         msg.Cc,
+					Bcc:        msg.Bcc,
+					Subject:    msg.Subject,
+					Headers:    msg.Headers,
+					CustomArgs: msg.Metadata,
+				})
+			}
+
+			id, err := s.post(data)
+			for _, i := range chunk {
+				ids[i], errs[i] = id, err
+			}
+		}
+	}
+
+	return ids, errs
+}
+
+func (s *Sender) post(data message) (string, error) {
 	args, err := json.Marshal(&data)
 	if err != nil {
-		return err
+		return "", app.PermanentError{Err: err}
 	}
 
 	request := api.GetRequest(s.key, v3URL, s.url)
@@ -74,18 +146,141 @@ func (s *Sender) Send(msg model.Message) error {
 
 	resp, err := api.API(request)
 	if err != nil {
-		return err
+		return "", app.TransientError{Err: err}
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		log.WithFields(log.Fields{
 			"request":      data,
 			"responseCode": resp.StatusCode,
 			"responseBody": resp.Body,
 		}).Error("sendgrid call failed")
 
-		return fmt.Errorf("sendgrid api error %d", resp.StatusCode)
+		return "", classify(resp)
+	}
+
+	return http.Header(resp.Headers).Get(headerMessageID), nil
+}
+
+// payload builds the SendGrid message without personalizations.
+func payload(msg model.Message) message {
+	data := message{
+		From:        msg.From,
+		Subject:     msg.Subject,
+		Content:     contents(msg),
+		Attachments: attachments(msg.Attachments),
+		Headers:     msg.Headers,
+		Categories:  msg.Tags,
+		CustomArgs:  msg.Metadata,
+	}
+
+	// reply_to and reply_to_list cannot be used together.
+	switch len(msg.ReplyTo) {
+	case 0:
+	case 1:
+		data.ReplyTo = &msg.ReplyTo[0]
+	default:
+		data.ReplyToList = msg.ReplyTo
+	}
+
+	return data
+}
+
+// groups gets the indexes of the messages which can be sent as
+// personalizations of the same message, in the order of the messages.
+func groups(msgs []model.Message) [][]int {
+	out := [][]int{}
+	index := map[string]int{}
+
+	for n, msg := range msgs {
+		k := groupKey(msg)
+		g, ok := index[k]
+		if !ok {
+			g = len(out)
+			index[k] = g
+			out = append(out, nil)
+		}
+		out[g] = append(out[g], n)
+	}
+
+	return out
+}
+
+// groupKey gets the identity of the message parts shared by personalizations.
+func groupKey(msg model.Message) string {
+	data, _ := json.Marshal([]interface{}{
+		msg.From,
+		msg.ReplyTo,
+		msg.BodyType,
+		msg.Body,
+		msg.Text,
+		msg.Attachments,
+		msg.Tags,
+	})
+	return string(data)
+}
+
+// contents gets the message body, the plain text alternative goes first as
+// required by SendGrid.
+func contents(msg model.Message) []content {
+	body := content{Type: msg.BodyType, Value: msg.Body}
+	if msg.Text == "" {
+		return []content{body}
+	}
+	return []content{{Type: "text/plain", Value: msg.Text}, body}
+}
+
+func attachments(atts []model.Attachment) []attachment {
+	var out []attachment
+	for _, att := range atts {
+		out = append(out, attachment{
+			Content:     att.Content,
+			Type:        att.ContentType,
+			Filename:    att.Filename,
+			Disposition: att.Disposition,
+			ContentID:   att.ContentID,
+		})
+	}
+	return out
+}
+
+// classify maps an unsuccessful response to a send error. Rate limits and
+// server errors are transient, so are authorization errors and unknown
+// endpoints as they are caused by the provider configuration rather than by
+// the message. Other client errors mean the message will never be accepted.
+func classify(resp *rest.Response) error {
+	err := fmt.Errorf("sendgrid api error %d", resp.StatusCode)
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return app.RateLimitError{Err: err, After: retryAfter(resp.Headers)}
+	case resp.StatusCode >= http.StatusInternalServerError,
+		resp.StatusCode == http.StatusUnauthorized,
+		resp.StatusCode == http.StatusForbidden,
+		resp.StatusCode == http.StatusNotFound:
+		return app.TransientError{Err: err}
+	default:
+		return app.PermanentError{Err: err}
+	}
+}
+
+// retryAfter gets the delay requested by the rate limit headers.
+func retryAfter(headers map[string][]string) time.Duration {
+	hdr := http.Header(headers)
+
+	if v := hdr.Get(headerRetryAfter); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil {
+			return time.Duration(sec) * time.Second
+		}
+	}
+
+	if v := hdr.Get(headerRateLimitReset); v != "" {
+		if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+			if after := time.Until(time.Unix(ts, 0)); after > 0 {
+				return after
+			}
+		}
 	}
 
-	return nil
+	return defaultRetryAfter
 }
@@ -0,0 +1,53 @@
+package smtp
+
+import (
+	"errors"
+	"net/smtp"
+)
+
+const (
+	errorUnencryptedConnection = "unencrypted connection"
+	errorWrongHostName         = "wrong host name"
+	errorUnexpectedChallenge   = "unexpected server challenge"
+)
+
+type login struct {
+	username string
+	password string
+	host     string
+}
+
+// loginAuth returns an smtp.Auth implementing the LOGIN mechanism. Like
+// smtp.PlainAuth it only sends credentials over TLS or to localhost.
+func loginAuth(username, password, host string) smtp.Auth {
+	return &login{username: username, password: password, host: host}
+}
+
+func (a *login) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New(errorUnencryptedConnection)
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New(errorWrongHostName)
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *login) Next(challenge []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch string(challenge) {
+	case "Username:":
+		return []byte(a.username), nil
+	case "Password:":
+		return []byte(a.password), nil
+	default:
+		return nil, errors.New(errorUnexpectedChallenge)
+	}
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
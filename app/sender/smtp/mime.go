@@ -0,0 +1,311 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vbogretsov/sendmail/model"
+)
+
+const (
+	crlf                = "\r\n"
+	charset             = "utf-8"
+	undisclosed         = "undisclosed-recipients:;"
+	messageIDRandomSize = 16
+	headerTags          = "X-Tags"
+	headerMetadata      = "X-Metadata"
+	base64LineSize      = 57 // encoded to 76 characters
+	maxLineSize         = 78
+)
+
+// build builds an RFC 5322 message from the model message and returns it
+// along with its Message-ID. Bcc recipients are deliberately omitted from
+// the headers, they only get the message via the SMTP envelope.
+func build(msg model.Message) (string, []byte, error) {
+	id, err := messageID(msg.From.Email)
+	if err != nil {
+		return "", nil, err
+	}
+
+	buf := new(bytes.Buffer)
+
+	writeHeader(buf, "From", address(msg.From))
+
+	if len(msg.To) > 0 {
+		writeHeader(buf, "To", addressList(msg.To))
+	} else if len(msg.Cc) == 0 {
+		writeHeader(buf, "To", undisclosed)
+	}
+
+	if len(msg.Cc) > 0 {
+		writeHeader(buf, "Cc", addressList(msg.Cc))
+	}
+
+	if len(msg.ReplyTo) > 0 {
+		writeHeader(buf, "Reply-To", addressList(msg.ReplyTo))
+	}
+
+	writeHeader(buf, "Subject", mime.QEncoding.Encode(charset, msg.Subject))
+	writeHeader(buf, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(buf, "Message-ID", id)
+
+	if err := writeCustom(buf, msg); err != nil {
+		return "", nil, err
+	}
+	writeHeader(buf, "MIME-Version", "1.0")
+
+	root := content(msg)
+	for _, key := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+		if value := root.header.Get(key); value != "" {
+			writeHeader(buf, key, value)
+		}
+	}
+	buf.WriteString(crlf)
+
+	if err := root.write(buf); err != nil {
+		return "", nil, err
+	}
+
+	return id, buf.Bytes(), nil
+}
+
+// entity represents a MIME entity, write writes its content.
+type entity struct {
+	header textproto.MIMEHeader
+	write  func(io.Writer) error
+}
+
+// content gets the MIME structure of the message. The plain text
+// alternative goes first and inline images are related to the HTML body:
+//
+//	multipart/mixed
+//	  multipart/alternative
+//	    text
+//	    multipart/related
+//	      body
+//	      inline images
+//	  attachments
+//
+// multipart entities having a single part are omitted.
+func content(msg model.Message) entity {
+	related := []entity{body(msg.BodyType, msg.Body)}
+	mixed := []entity{}
+
+	for _, att := range msg.Attachments {
+		if att.ContentID != "" {
+			related = append(related, attachment(att))
+		} else {
+			mixed = append(mixed, attachment(att))
+		}
+	}
+
+	root := multipartOf("multipart/related", related, map[string]string{
+		"type": msg.BodyType,
+	})
+
+	if msg.Text != "" {
+		root = multipartOf("multipart/alternative", []entity{
+			body("text/plain", msg.Text),
+			root,
+		}, nil)
+	}
+
+	return multipartOf("multipart/mixed", append([]entity{root}, mixed...), nil)
+}
+
+func body(mediaType, text string) entity {
+	return entity{
+		header: textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType(
+				mediaType,
+				map[string]string{"charset": charset})},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		},
+		write: func(w io.Writer) error {
+			return writeQuoted(w, text)
+		},
+	}
+}
+
+func attachment(att model.Attachment) entity {
+	header := textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType(
+			att.ContentType,
+			map[string]string{"name": att.Filename})},
+		"Content-Disposition": {mime.FormatMediaType(
+			att.Disposition,
+			map[string]string{"filename": att.Filename})},
+		"Content-Transfer-Encoding": {"base64"},
+	}
+	if att.ContentID != "" {
+		header["Content-ID"] = []string{"<" + att.ContentID + ">"}
+	}
+
+	return entity{
+		header: header,
+		write: func(w io.Writer) error {
+			return writeBase64(w, att.Content)
+		},
+	}
+}
+
+// multipartOf creates a multipart entity of the media type provided, a
+// single part is returned as is.
+func multipartOf(mediaType string, parts []entity, params map[string]string) entity {
+	if len(parts) == 1 {
+		return parts[0]
+	}
+
+	boundary := multipart.NewWriter(ioutil.Discard).Boundary()
+
+	if params == nil {
+		params = map[string]string{}
+	}
+	params["boundary"] = boundary
+
+	return entity{
+		header: textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType(mediaType, params)},
+		},
+		write: func(w io.Writer) error {
+			mw := multipart.NewWriter(w)
+			if err := mw.SetBoundary(boundary); err != nil {
+				return err
+			}
+
+			for _, part := range parts {
+				pw, err := mw.CreatePart(part.header)
+				if err != nil {
+					return err
+				}
+				if err := part.write(pw); err != nil {
+					return err
+				}
+			}
+
+			return mw.Close()
+		},
+	}
+}
+
+func writeQuoted(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeBase64 writes the base64 encoded content wrapped to lines of 76
+// characters as required by RFC 2045.
+func writeBase64(w io.Writer, content string) error {
+	data, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		n := base64LineSize
+		if n > len(data) {
+			n = len(data)
+		}
+		line := base64.StdEncoding.EncodeToString(data[:n]) + crlf
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// writeCustom writes the custom headers sorted by name followed by the tags
+// and the metadata, the metadata is a JSON object.
+func writeCustom(buf *bytes.Buffer, msg model.Message) error {
+	names := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		writeHeader(buf, name, mime.QEncoding.Encode(charset, msg.Headers[name]))
+	}
+
+	if len(msg.Tags) > 0 {
+		writeHeader(buf, headerTags, mime.QEncoding.Encode(charset, strings.Join(msg.Tags, ", ")))
+	}
+
+	if len(msg.Metadata) > 0 {
+		data, err := json.Marshal(msg.Metadata)
+		if err != nil {
+			return err
+		}
+		writeHeader(buf, headerMetadata, mime.QEncoding.Encode(charset, string(data)))
+	}
+
+	return nil
+}
+
+// writeHeader writes the header folded at spaces so its lines do not exceed
+// maxLineSize characters where possible, as recommended by RFC 5322. Spaces
+// separate encoded words, so encoded values are folded as well. A line is
+// never folded before its first word, so a long word stays on the key line.
+func writeHeader(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key)
+	buf.WriteString(":")
+
+	n, empty := len(key)+1, true
+	for _, word := range strings.Split(value, " ") {
+		if word != "" && !empty && n+1+len(word) > maxLineSize {
+			buf.WriteString(crlf)
+			n, empty = 0, true
+		}
+		buf.WriteString(" ")
+		buf.WriteString(word)
+		n += 1 + len(word)
+		empty = empty && word == ""
+	}
+
+	buf.WriteString(crlf)
+}
+
+func address(addr model.Address) string {
+	a := mail.Address{Name: addr.Name, Address: addr.Email}
+	return a.String()
+}
+
+func addressList(addrs []model.Address) string {
+	list := make([]string, len(addrs))
+	for i, addr := range addrs {
+		list[i] = address(addr)
+	}
+	return strings.Join(list, ", ")
+}
+
+func messageID(from string) (string, error) {
+	buf := make([]byte, messageIDRandomSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	domain := "localhost"
+	if n := strings.LastIndex(from, "@"); n != -1 {
+		domain = from[n+1:]
+	}
+
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(buf), domain), nil
+}
@@ -0,0 +1,263 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+)
+
+const (
+	schemeSMTP  = "smtp"
+	schemeSMTPS = "smtps"
+
+	authNone    = "none"
+	authPlain   = "plain"
+	authLogin   = "login"
+	authCRAMMD5 = "cram-md5"
+
+	starttlsAuto     = "auto"
+	starttlsRequired = "required"
+	starttlsDisabled = "disabled"
+
+	defaultPortSMTP  = "25"
+	defaultPortSMTPS = "465"
+	defaultHelo      = "localhost"
+	defaultTimeout   = time.Second * 30
+)
+
+const (
+	errorUnsupportedScheme   = "unsupported smtp scheme %s"
+	errorUnsupportedAuth     = "unsupported smtp auth %s"
+	errorUnsupportedStartTLS = "unsupported smtp starttls mode %s"
+	errorStartTLSUnsupported = "smtp server does not support STARTTLS"
+)
+
+// Sender represents an SMTP sender.
+type Sender struct {
+	addr     string
+	host     string
+	helo     string
+	implicit bool
+	starttls string
+	auth     smtp.Auth
+	tls      *tls.Config
+	timeout  time.Duration
+}
+
+// New creates new SMTP sender. The url has the form
+// smtp[s]://[user@]host[:port][?auth=...&starttls=...&insecure=...&helo=...&timeout=...]
+// and the key is the password used for authentication.
+func New(rawurl, key string) (app.Sender, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Sender{
+		host:     u.Hostname(),
+		helo:     defaultHelo,
+		starttls: starttlsAuto,
+		timeout:  defaultTimeout,
+	}
+
+	port := u.Port()
+
+	switch u.Scheme {
+	case schemeSMTP:
+		if port == "" {
+			port = defaultPortSMTP
+		}
+	case schemeSMTPS:
+		s.implicit = true
+		if port == "" {
+			port = defaultPortSMTPS
+		}
+	default:
+		return nil, fmt.Errorf(errorUnsupportedScheme, u.Scheme)
+	}
+
+	s.addr = net.JoinHostPort(s.host, port)
+
+	query := u.Query()
+
+	insecure := false
+	if v := query.Get("insecure"); v != "" {
+		if insecure, err = strconv.ParseBool(v); err != nil {
+			return nil, err
+		}
+	}
+	s.tls = &tls.Config{ServerName: s.host, InsecureSkipVerify: insecure}
+
+	if v := query.Get("helo"); v != "" {
+		s.helo = v
+	}
+
+	if v := query.Get("timeout"); v != "" {
+		if s.timeout, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+
+	switch v := query.Get("starttls"); v {
+	case "":
+	case starttlsAuto, starttlsRequired, starttlsDisabled:
+		s.starttls = v
+	default:
+		return nil, fmt.Errorf(errorUnsupportedStartTLS, v)
+	}
+
+	username := u.User.Username()
+
+	mechanism := query.Get("auth")
+	if mechanism == "" {
+		mechanism = authNone
+		if username != "" {
+			mechanism = authPlain
+		}
+	}
+
+	switch mechanism {
+	case authNone:
+	case authPlain:
+		s.auth = smtp.PlainAuth("", username, key, s.host)
+	case authLogin:
+		s.auth = loginAuth(username, key, s.host)
+	case authCRAMMD5:
+		s.auth = smtp.CRAMMD5Auth(username, key)
+	default:
+		return nil, fmt.Errorf(errorUnsupportedAuth, mechanism)
+	}
+
+	return &s, nil
+}
+
+// Send sends an email via SMTP. The Message-ID header value is returned as
+// the message id.
+func (s *Sender) Send(msg model.Message) (string, error) {
+	id, data, err := build(msg)
+	if err != nil {
+		return "", app.PermanentError{Err: err}
+	}
+
+	cl, err := s.dial()
+	if err != nil {
+		return "", app.TransientError{Err: err}
+	}
+	defer cl.Close()
+
+	if err := cl.Mail(msg.From.Email); err != nil {
+		return "", classify(err)
+	}
+
+	for _, rcpt := range recipients(msg) {
+		if err := cl.Rcpt(rcpt); err != nil {
+			return "", classify(err)
+		}
+	}
+
+	wr, err := cl.Data()
+	if err != nil {
+		return "", classify(err)
+	}
+
+	if _, err := wr.Write(data); err != nil {
+		wr.Close()
+		return "", classify(err)
+	}
+
+	if err := wr.Close(); err != nil {
+		return "", classify(err)
+	}
+
+	// The message is accepted at this point, a failed QUIT must not make
+	// the caller send it again.
+	cl.Quit()
+	return id, nil
+}
+
+func (s *Sender) dial() (*smtp.Client, error) {
+	dialer := &net.Dialer{Timeout: s.timeout}
+
+	var conn net.Conn
+	var err error
+
+	if s.implicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	cl, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := s.handshake(cl); err != nil {
+		cl.Close()
+		return nil, err
+	}
+
+	return cl, nil
+}
+
+func (s *Sender) handshake(cl *smtp.Client) error {
+	if err := cl.Hello(s.helo); err != nil {
+		return err
+	}
+
+	if !s.implicit && s.starttls != starttlsDisabled {
+		ok, _ := cl.Extension("STARTTLS")
+		if ok {
+			if err := cl.StartTLS(s.tls); err != nil {
+				return err
+			}
+		} else if s.starttls == starttlsRequired {
+			return errors.New(errorStartTLSUnsupported)
+		}
+	}
+
+	if s.auth != nil {
+		if err := cl.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// classify maps an error of a mail transaction to a send error. Permanent
+// negative replies (5yz) mean the message will never be accepted, anything
+// else including transient negative replies (4yz) may succeed on retry.
+// Errors during connection, handshake and authentication are always
+// transient as they do not depend on the message.
+func classify(err error) error {
+	if e, ok := err.(*textproto.Error); ok && e.Code >= 500 {
+		return app.PermanentError{Err: err}
+	}
+	return app.TransientError{Err: err}
+}
+
+func recipients(msg model.Message) []string {
+	rcpts := []string{}
+	for _, group := range [][]model.Address{msg.To, msg.Cc, msg.Bcc} {
+		for _, addr := range group {
+			rcpts = append(rcpts, addr.Email)
+		}
+	}
+	return rcpts
+}
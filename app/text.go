@@ -0,0 +1,157 @@
+package app
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// skipped are elements without readable text.
+var skipped = map[atom.Atom]bool{
+	atom.Head:     true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Template: true,
+}
+
+// paragraphs are elements separated by a blank line.
+var paragraphs = map[atom.Atom]bool{
+	atom.P:          true,
+	atom.H1:         true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.H5:         true,
+	atom.H6:         true,
+	atom.Ul:         true,
+	atom.Ol:         true,
+	atom.Table:      true,
+	atom.Blockquote: true,
+	atom.Pre:        true,
+	atom.Hr:         true,
+}
+
+// breaks are elements starting a new line.
+var breaks = map[atom.Atom]bool{
+	atom.Div:     true,
+	atom.Tr:      true,
+	atom.Section: true,
+	atom.Article: true,
+	atom.Header:  true,
+	atom.Footer:  true,
+}
+
+// plain derives the plain text alternative of the HTML body. Paragraphs are
+// separated by blank lines, list items start with "- ", images are replaced
+// by their alt text and link targets follow the link text in parentheses.
+func plain(body string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	buf := new(strings.Builder)
+	writeText(buf, doc)
+	return normalize(buf.String())
+}
+
+func writeText(buf *strings.Builder, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		buf.WriteString(collapse(n.Data))
+		return
+	case html.ElementNode:
+		if skipped[n.DataAtom] {
+			return
+		}
+	}
+
+	switch {
+	case n.DataAtom == atom.Br:
+		buf.WriteString("\n")
+	case n.DataAtom == atom.Li:
+		buf.WriteString("\n- ")
+	case n.DataAtom == atom.Td, n.DataAtom == atom.Th:
+		buf.WriteString(" ")
+	case n.DataAtom == atom.Img:
+		buf.WriteString(attr(n, "alt"))
+	case paragraphs[n.DataAtom]:
+		buf.WriteString("\n\n")
+	case breaks[n.DataAtom]:
+		buf.WriteString("\n")
+	}
+
+	start := buf.Len()
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		writeText(buf, c)
+	}
+
+	switch {
+	case n.DataAtom == atom.A:
+		text := strings.TrimSpace(buf.String()[start:])
+		href := attr(n, "href")
+		if target := strings.TrimPrefix(href, "mailto:"); link(href) && target != text {
+			buf.WriteString(" (" + target + ")")
+		}
+	case paragraphs[n.DataAtom]:
+		buf.WriteString("\n\n")
+	case breaks[n.DataAtom]:
+		buf.WriteString("\n")
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// link reports whether the link target is worth mentioning, anchors and
+// inline images are not.
+func link(href string) bool {
+	return href != "" && !strings.HasPrefix(href, "#") && !strings.HasPrefix(href, "cid:")
+}
+
+// collapse replaces whitespace runs with a single space.
+func collapse(text string) string {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		if text == "" {
+			return ""
+		}
+		return " "
+	}
+
+	out := strings.Join(words, " ")
+	if strings.TrimLeft(text[:1], " \t\r\n") == "" {
+		out = " " + out
+	}
+	if strings.TrimRight(text[len(text)-1:], " \t\r\n") == "" {
+		out += " "
+	}
+	return out
+}
+
+// normalize trims the lines and keeps at most one blank line in a row.
+func normalize(text string) string {
+	out := []string{}
+	blank := true
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if !blank {
+				out = append(out, "")
+			}
+			blank = true
+			continue
+		}
+		out = append(out, line)
+		blank = false
+	}
+
+	return strings.TrimSpace(strings.Join(out, "\n")) + "\n"
+}
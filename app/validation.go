@@ -1,6 +1,14 @@
 package app
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"mime"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
 	"github.com/vbogretsov/go-validation"
 	"github.com/vbogretsov/go-validation/rule"
 
@@ -12,12 +20,117 @@ const (
 	errorMissingRecipients = "missing recipients"
 	errorInvalidEmail      = "invalid email"
 	errorInvalidBodyType   = "invalid body type"
+	errorUnexpectedText    = "text requires HTML body"
+	errorTooManyRecipients = "too many recipients"
+	errorInvalidSegment    = "invalid template language or name"
+)
+
+const (
+	errorInvalidFilename    = "invalid filename"
+	errorBlockedFilename    = "blocked file extension"
+	errorInvalidType        = "invalid content type"
+	errorBlockedType        = "blocked content type"
+	errorInvalidContent     = "invalid base64 content"
+	errorInvalidRef         = "invalid ref"
+	errorMissingContent     = "either content or ref required"
+	errorInvalidDisposition = "invalid disposition"
+	errorTooLarge           = "attachments too large"
+	errorInvalidContentID   = "invalid content id"
+	errorDuplicateContentID = "duplicate content id"
+)
+
+const (
+	errorInvalidHeader   = "invalid header"
+	errorReservedHeader  = "reserved header"
+	errorHeaderTooLong   = "header too long"
+	errorInvalidTag      = "invalid tag"
+	errorTooManyTags     = "too many tags"
+	errorInvalidMetadata = "invalid metadata"
+	errorMetadataTooLong = "metadata too long"
 )
 
+const bodyTypeHTML = "text/html"
+
+// maxRecipients is the maximum number of recipients of a batch.
+const maxRecipients = 10000
+
+// Limits of tags, SendGrid rejects emails exceeding them.
+const (
+	maxTags    = 10
+	maxTagSize = 255
+)
+
+// Limits of headers and metadata. Headers are folded at whitespace, the
+// line of an unbreakable value cannot exceed the RFC 5322 limit of 998
+// characters. The metadata is sent as a JSON object in the X-Metadata
+// header.
+const (
+	maxHeaderSize   = 998 - len(": ")
+	maxMetadataSize = 998 - len("X-Metadata: ")
+)
+
+// reservedHeaders are set by senders, custom headers cannot override them.
+var reservedHeaders = map[string]bool{
+	"from":                      true,
+	"to":                        true,
+	"cc":                        true,
+	"bcc":                       true,
+	"reply-to":                  true,
+	"sender":                    true,
+	"subject":                   true,
+	"date":                      true,
+	"message-id":                true,
+	"mime-version":              true,
+	"content-type":              true,
+	"content-transfer-encoding": true,
+	"content-disposition":       true,
+	"content-id":                true,
+	"return-path":               true,
+	"received":                  true,
+	"dkim-signature":            true,
+	"x-sg-id":                   true,
+	"x-sg-eid":                  true,
+	"x-tags":                    true,
+	"x-metadata":                true,
+}
+
+// maxAttachmentsSize is the maximum total size of the decoded attachments of
+// an email.
+const maxAttachmentsSize = 20 << 20
+
+// blockedExtensions and blockedTypes identify executable attachments, mail
+// providers reject or quarantine emails carrying them.
+var (
+	blockedExtensions = map[string]bool{
+		".bat": true, ".cmd": true, ".com": true, ".cpl": true, ".dll": true,
+		".exe": true, ".hta": true, ".jar": true, ".js": true, ".jse": true,
+		".lnk": true, ".msi": true, ".pif": true, ".ps1": true, ".reg": true,
+		".scr": true, ".vbe": true, ".vbs": true, ".wsf": true, ".wsh": true,
+	}
+	blockedTypes = map[string]bool{
+		"application/hta":                               true,
+		"application/java-archive":                      true,
+		"application/javascript":                        true,
+		"application/x-javascript":                      true,
+		"application/x-msdos-program":                   true,
+		"application/x-msdownload":                      true,
+		"application/x-ms-installer":                    true,
+		"application/x-ms-shortcut":                     true,
+		"application/x-sh":                              true,
+		"application/vnd.microsoft.portable-executable": true,
+		"text/javascript":                               true,
+	}
+)
+
+// contentIDPattern restricts content ids to characters safe both in the
+// Content-ID header and in cid: URLs.
+var contentIDPattern = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+
 var (
 	strRequired = rule.StrRequired(errorStrRequired)
 	strEmail    = rule.StrEmail(errorInvalidEmail)
-	bodyTypes   = rule.In([]interface{}{"text/plain", "text/html"}, errorInvalidBodyType)
+	bodyTypes   = rule.In([]interface{}{"text/plain", bodyTypeHTML}, errorInvalidBodyType)
+	disposition = rule.In([]interface{}{"", dispositionAttachment, dispositionInline}, errorInvalidDisposition)
 )
 
 func self(v interface{}) interface{} {
@@ -68,6 +181,128 @@ func messageBody(v interface{}) interface{} {
 	return &(v.(*model.Message)).Body
 }
 
+func requestAttachments(v interface{}) interface{} {
+	return &((v.(*model.Request)).Attachments)
+}
+
+func messageAttachments(v interface{}) interface{} {
+	return &(v.(*model.Message)).Attachments
+}
+
+func attachmentFilename(v interface{}) interface{} {
+	return &(v.(*model.Attachment)).Filename
+}
+
+func attachmentContentType(v interface{}) interface{} {
+	return &(v.(*model.Attachment)).ContentType
+}
+
+func attachmentContent(v interface{}) interface{} {
+	return &(v.(*model.Attachment)).Content
+}
+
+func attachmentRef(v interface{}) interface{} {
+	return &(v.(*model.Attachment)).Ref
+}
+
+func attachmentDisposition(v interface{}) interface{} {
+	return &(v.(*model.Attachment)).Disposition
+}
+
+func attachmentContentID(v interface{}) interface{} {
+	return &(v.(*model.Attachment)).ContentID
+}
+
+func attachmentIter(v interface{}, i int) interface{} {
+	return &((*v.(*[]model.Attachment))[i])
+}
+
+// textAlternative rejects the plain text alternative of a non HTML body.
+func textAlternative(v interface{}) error {
+	msg := v.(*model.Message)
+	if msg.Text != "" && msg.BodyType != bodyTypeHTML {
+		return validation.Error{Message: errorUnexpectedText}
+	}
+	return nil
+}
+
+func requestReplyTo(v interface{}) interface{} {
+	return &((v.(*model.Request)).ReplyTo)
+}
+
+func requestHeaders(v interface{}) interface{} {
+	return &((v.(*model.Request)).Headers)
+}
+
+func requestTags(v interface{}) interface{} {
+	return &((v.(*model.Request)).Tags)
+}
+
+func requestMetadata(v interface{}) interface{} {
+	return &((v.(*model.Request)).Metadata)
+}
+
+func messageReplyTo(v interface{}) interface{} {
+	return &(v.(*model.Message)).ReplyTo
+}
+
+func messageHeaders(v interface{}) interface{} {
+	return &(v.(*model.Message)).Headers
+}
+
+func messageTags(v interface{}) interface{} {
+	return &(v.(*model.Message)).Tags
+}
+
+func messageMetadata(v interface{}) interface{} {
+	return &(v.(*model.Message)).Metadata
+}
+
+func batchTemplateLang(v interface{}) interface{} {
+	return &((v.(*model.BatchRequest)).TemplateLang)
+}
+
+func batchTemplateName(v interface{}) interface{} {
+	return &((v.(*model.BatchRequest)).TemplateName)
+}
+
+func batchRecipients(v interface{}) interface{} {
+	return &((v.(*model.BatchRequest)).Recipients)
+}
+
+func batchReplyTo(v interface{}) interface{} {
+	return &((v.(*model.BatchRequest)).ReplyTo)
+}
+
+func batchAttachments(v interface{}) interface{} {
+	return &((v.(*model.BatchRequest)).Attachments)
+}
+
+func batchHeaders(v interface{}) interface{} {
+	return &((v.(*model.BatchRequest)).Headers)
+}
+
+func batchTags(v interface{}) interface{} {
+	return &((v.(*model.BatchRequest)).Tags)
+}
+
+func batchMetadata(v interface{}) interface{} {
+	return &((v.(*model.BatchRequest)).Metadata)
+}
+
+// segment rejects template languages and names which could refer to files
+// other than templates: ones with path separators or "..", ones starting
+// with underscore as layouts, partials and assets do and ones with a file
+// extension. Names may contain other dots, e.g. order.confirmed.
+func segment(v interface{}) error {
+	s := *v.(*string)
+	if strings.ContainsAny(s, "/\\") || strings.Contains(s, "..") ||
+		strings.HasPrefix(s, "_") || mime.TypeByExtension(path.Ext(s)) != "" {
+		return validation.Error{Message: errorInvalidSegment}
+	}
+	return nil
+}
+
 func atLeastOneRecipient(v interface{}) error {
 	req := v.(*model.Request)
 	if len(req.To) == 0 && len(req.Cc) == 0 && len(req.Bcc) == 0 {
@@ -76,6 +311,264 @@ func atLeastOneRecipient(v interface{}) error {
 	return nil
 }
 
+// filename rejects file names containing path separators or control
+// characters, the name is sent in MIME headers, and names of executables.
+func filename(v interface{}) error {
+	name := *v.(*string)
+	if strings.ContainsAny(name, "/\\") || strings.IndexFunc(name, control) != -1 {
+		return validation.Error{Message: errorInvalidFilename}
+	}
+	if blockedExtensions[strings.ToLower(path.Ext(name))] {
+		return validation.Error{Message: errorBlockedFilename}
+	}
+	return nil
+}
+
+func control(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
+
+// mediaType rejects malformed media types, multipart ones as they would
+// break the MIME structure of the email and types of executables.
+func mediaType(v interface{}) error {
+	ct := *v.(*string)
+	if ct == "" {
+		return nil
+	}
+
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil || !strings.Contains(mt, "/") || strings.HasPrefix(mt, "multipart/") {
+		return validation.Error{Message: errorInvalidType}
+	}
+	if blockedTypes[mt] {
+		return validation.Error{Message: errorBlockedType}
+	}
+	return nil
+}
+
+func base64Content(v interface{}) error {
+	if _, err := base64.StdEncoding.DecodeString(*v.(*string)); err != nil {
+		return validation.Error{Message: errorInvalidContent}
+	}
+	return nil
+}
+
+func assetRef(v interface{}) error {
+	ref := *v.(*string)
+	if ref != "" && !validRef(ref) {
+		return validation.Error{
+			Message: errorInvalidRef,
+			Params:  validation.Params{"prefix": prefixAssets},
+		}
+	}
+	return nil
+}
+
+func contentID(v interface{}) error {
+	id := *v.(*string)
+	if id != "" && !contentIDPattern.MatchString(id) {
+		return validation.Error{Message: errorInvalidContentID}
+	}
+	return nil
+}
+
+func contentOrRef(v interface{}) error {
+	att := v.(*model.Attachment)
+	if (att.Content == "") == (att.Ref == "") {
+		return validation.Error{Message: errorMissingContent}
+	}
+	return nil
+}
+
+// attachmentsSize limits the total size of the attachments content, assets
+// are counted once loaded.
+func attachmentsSize(v interface{}) error {
+	size := 0
+	for _, att := range *v.(*[]model.Attachment) {
+		size += attachmentSize(att)
+	}
+
+	if size > maxAttachmentsSize {
+		return validation.Error{
+			Message: errorTooLarge,
+			Params:  validation.Params{"max": maxAttachmentsSize},
+		}
+	}
+	return nil
+}
+
+func uniqueContentIDs(v interface{}) error {
+	seen := map[string]bool{}
+	for _, att := range *v.(*[]model.Attachment) {
+		if att.ContentID == "" {
+			continue
+		}
+		if seen[att.ContentID] {
+			return validation.Error{
+				Message: errorDuplicateContentID,
+				Params:  validation.Params{"contentId": att.ContentID},
+			}
+		}
+		seen[att.ContentID] = true
+	}
+	return nil
+}
+
+// headers rejects malformed header names, reserved headers, values
+// containing line breaks, which would allow injecting headers, and headers
+// too long to fit a line.
+func headers(v interface{}) error {
+	hs := *v.(*map[string]string)
+	for _, name := range keys(hs) {
+		value := hs[name]
+		if !fieldName(name) || !safe(value) {
+			return validation.Error{
+				Message: errorInvalidHeader,
+				Params:  validation.Params{"header": name},
+			}
+		}
+		if len(name)+len(value) > maxHeaderSize {
+			return validation.Error{
+				Message: errorHeaderTooLong,
+				Params:  validation.Params{"header": name, "max": maxHeaderSize},
+			}
+		}
+		if reservedHeaders[strings.ToLower(name)] {
+			return validation.Error{
+				Message: errorReservedHeader,
+				Params:  validation.Params{"header": name},
+			}
+		}
+	}
+	return nil
+}
+
+// fieldName reports whether the name is a valid RFC 5322 header field name.
+func fieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c < '!' || c > '~' || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// safe reports whether the value has no control characters except tabs.
+func safe(value string) bool {
+	return strings.IndexFunc(value, func(r rune) bool {
+		return r != '\t' && control(r)
+	}) == -1
+}
+
+func tags(v interface{}) error {
+	list := *v.(*[]string)
+	if len(list) > maxTags {
+		return validation.Error{
+			Message: errorTooManyTags,
+			Params:  validation.Params{"max": maxTags},
+		}
+	}
+
+	for _, tag := range list {
+		if tag == "" || len(tag) > maxTagSize || !safe(tag) {
+			return validation.Error{
+				Message: errorInvalidTag,
+				Params:  validation.Params{"tag": tag},
+			}
+		}
+	}
+	return nil
+}
+
+// metadata rejects empty keys, keys and values with control characters and
+// metadata exceeding maxMetadataSize once encoded as JSON.
+func metadata(v interface{}) error {
+	md := *v.(*map[string]string)
+	for _, key := range keys(md) {
+		if key == "" || !safe(key) || !safe(md[key]) {
+			return validation.Error{
+				Message: errorInvalidMetadata,
+				Params:  validation.Params{"key": key},
+			}
+		}
+	}
+
+	if data, err := json.Marshal(md); err != nil || len(data) > maxMetadataSize {
+		return validation.Error{
+			Message: errorMetadataTooLong,
+			Params:  validation.Params{"max": maxMetadataSize},
+		}
+	}
+	return nil
+}
+
+// keys gets the sorted keys of the map, so that the first invalid entry is
+// reported the same way every time.
+func keys(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recipients limits the number of recipients of a batch, the recipients
+// themselves are validated once the request of each is built.
+func recipients(v interface{}) error {
+	n := len(*v.(*[]model.Recipient))
+	if n == 0 {
+		return validation.Error{Message: errorMissingRecipients}
+	}
+	if n > maxRecipients {
+		return validation.Error{
+			Message: errorTooManyRecipients,
+			Params:  validation.Params{"max": maxRecipients},
+		}
+	}
+	return nil
+}
+
+var attachmentRule = validation.Struct(&model.Attachment{}, "yaml", []validation.Field{
+	{
+		Attr:  attachmentFilename,
+		Rules: []validation.Rule{strRequired, validation.Func(filename)},
+	},
+	{
+		Attr:  attachmentContentType,
+		Rules: []validation.Rule{validation.Func(mediaType)},
+	},
+	{
+		Attr:  attachmentContent,
+		Rules: []validation.Rule{validation.Func(base64Content)},
+	},
+	{
+		Attr:  attachmentRef,
+		Rules: []validation.Rule{validation.Func(assetRef)},
+	},
+	{
+		Attr:  attachmentDisposition,
+		Rules: []validation.Rule{disposition},
+	},
+	{
+		Attr:  attachmentContentID,
+		Rules: []validation.Rule{validation.Func(contentID)},
+	},
+	{
+		Attr:  self,
+		Rules: []validation.Rule{validation.Func(contentOrRef)},
+	},
+})
+
+var attachmentsRules = []validation.Rule{
+	rule.SliceEach(attachmentIter, []validation.Rule{attachmentRule}),
+	validation.Func(attachmentsSize),
+	validation.Func(uniqueContentIDs),
+}
+
 var addressRule = validation.Struct(&model.Address{}, "yaml", []validation.Field{
 	{
 		Attr:  addressEmail,
@@ -83,36 +576,102 @@ var addressRule = validation.Struct(&model.Address{}, "yaml", []validation.Field
 	},
 })
 
-var requestRule = validation.Struct(&model.Request{}, "json", []validation.Field{
+// requestFields gets the rules of the request fields checked both when the
+// email is sent and when it is only rendered.
+func requestFields() []validation.Field {
+	return []validation.Field{
+		{
+			Attr:  requestTemplateLang,
+			Rules: []validation.Rule{strRequired, validation.Func(segment)},
+		},
+		{
+			Attr:  requestTemplateName,
+			Rules: []validation.Rule{strRequired, validation.Func(segment)},
+		},
+		{
+			Attr: requestTo,
+			Rules: []validation.Rule{
+				rule.SliceEach(addressIter, []validation.Rule{addressRule}),
+			},
+		},
+		{
+			Attr: requestCc,
+			Rules: []validation.Rule{
+				rule.SliceEach(addressIter, []validation.Rule{addressRule}),
+			},
+		},
+		{
+			Attr: requestBcc,
+			Rules: []validation.Rule{
+				rule.SliceEach(addressIter, []validation.Rule{addressRule}),
+			},
+		},
+		{
+			Attr: requestReplyTo,
+			Rules: []validation.Rule{
+				rule.SliceEach(addressIter, []validation.Rule{addressRule}),
+			},
+		},
+		{
+			Attr:  requestAttachments,
+			Rules: attachmentsRules,
+		},
+		{
+			Attr:  requestHeaders,
+			Rules: []validation.Rule{validation.Func(headers)},
+		},
+		{
+			Attr:  requestTags,
+			Rules: []validation.Rule{validation.Func(tags)},
+		},
+		{
+			Attr:  requestMetadata,
+			Rules: []validation.Rule{validation.Func(metadata)},
+		},
+	}
+}
+
+var requestRule = validation.Struct(&model.Request{}, "json", append(requestFields(), validation.Field{
+	Attr:  self,
+	Rules: []validation.Rule{validation.Func(atLeastOneRecipient)},
+}))(nil)
+
+var renderRule = validation.Struct(&model.Request{}, "json", requestFields())(nil)
+
+var batchRule = validation.Struct(&model.BatchRequest{}, "json", []validation.Field{
 	{
-		Attr:  requestTemplateLang,
-		Rules: []validation.Rule{strRequired},
+		Attr:  batchTemplateLang,
+		Rules: []validation.Rule{strRequired, validation.Func(segment)},
 	},
 	{
-		Attr:  requestTemplateName,
-		Rules: []validation.Rule{strRequired},
+		Attr:  batchTemplateName,
+		Rules: []validation.Rule{strRequired, validation.Func(segment)},
 	},
 	{
-		Attr: requestTo,
-		Rules: []validation.Rule{
-			rule.SliceEach(addressIter, []validation.Rule{addressRule}),
-		},
+		Attr:  batchRecipients,
+		Rules: []validation.Rule{validation.Func(recipients)},
 	},
 	{
-		Attr: requestCc,
+		Attr: batchReplyTo,
 		Rules: []validation.Rule{
 			rule.SliceEach(addressIter, []validation.Rule{addressRule}),
 		},
 	},
 	{
-		Attr: requestBcc,
-		Rules: []validation.Rule{
-			rule.SliceEach(addressIter, []validation.Rule{addressRule}),
-		},
+		Attr:  batchAttachments,
+		Rules: attachmentsRules,
 	},
 	{
-		Attr:  self,
-		Rules: []validation.Rule{validation.Func(atLeastOneRecipient)},
+		Attr:  batchHeaders,
+		Rules: []validation.Rule{validation.Func(headers)},
+	},
+	{
+		Attr:  batchTags,
+		Rules: []validation.Rule{validation.Func(tags)},
+	},
+	{
+		Attr:  batchMetadata,
+		Rules: []validation.Rule{validation.Func(metadata)},
 	},
 })(nil)
 
@@ -133,8 +692,30 @@ var messageRule = validation.Struct(&model.Message{}, "yaml", []validation.Field
 		Attr:  messageFrom,
 		Rules: []validation.Rule{addressRule},
 	},
+	{
+		Attr: messageReplyTo,
+		Rules: []validation.Rule{
+			rule.SliceEach(addressIter, []validation.Rule{addressRule}),
+		},
+	},
+	{
+		Attr:  messageAttachments,
+		Rules: attachmentsRules,
+	},
+	{
+		Attr:  messageHeaders,
+		Rules: []validation.Rule{validation.Func(headers)},
+	},
+	{
+		Attr:  messageTags,
+		Rules: []validation.Rule{validation.Func(tags)},
+	},
+	{
+		Attr:  messageMetadata,
+		Rules: []validation.Rule{validation.Func(metadata)},
+	},
 	{
 		Attr:  self,
-		Rules: []validation.Rule{},
+		Rules: []validation.Rule{validation.Func(textAlternative)},
 	},
 })(nil)
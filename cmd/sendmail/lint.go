@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/akamensky/argparse"
+	"github.com/vbogretsov/go-validation"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/app/loader"
+	"github.com/vbogretsov/sendmail/model"
+)
+
+const (
+	cmdLint  = "lint"
+	descLint = "check every template renders into a valid email"
+)
+
+const helpLintSamples = "directory containing <lang>/<name>.json template arguments samples"
+
+const (
+	errorListUnsupported = "templates loader does not support listing"
+	errorLintFailed      = "%d problem(s) found"
+)
+
+var (
+	templateLine = regexp.MustCompile(`^template: [^:]*:(\d+)`)
+	yamlLine     = regexp.MustCompile(`^yaml: line (\d+):`)
+	listItem     = regexp.MustCompile(`^\s*(- )?`)
+)
+
+type lintArgT struct {
+	template struct {
+		Path    *string
+		Samples *string
+	}
+}
+
+// issue represents a template problem, issues are printed one JSON object
+// per line.
+type issue struct {
+	File   string                 `json:"file"`
+	Lang   string                 `json:"lang"`
+	Name   string                 `json:"name"`
+	Line   int                    `json:"line,omitempty"`
+	Path   string                 `json:"path,omitempty"`
+	Error  string                 `json:"error"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// jsonError represents a validation error in the format reported by the APIs.
+type jsonError struct {
+	Path   string                 `json:"path,omitempty"`
+	Error  string                 `json:"error"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+var (
+	lintArgs   = lintArgT{}
+	lintParser = argparse.NewParser(fmt.Sprintf("%s %s", name, cmdLint), descLint)
+)
+
+func init() {
+	lintArgs.template.Path = lintParser.String(
+		"",
+		"templates-path",
+		&argparse.Options{
+			Required: true,
+			Help:     helpTemplatePath,
+		})
+	lintArgs.template.Samples = lintParser.String(
+		"",
+		"samples-path",
+		&argparse.Options{
+			Required: false,
+			Help:     helpLintSamples,
+		})
+}
+
+// lint renders every template found under the templates root and prints
+// the problems found, it fails if any problem is found.
+func lint(argv []string) error {
+	if err := lintParser.Parse(argv); err != nil {
+		return err
+	}
+
+	lr, err := loader.New(*lintArgs.template.Path)
+	if err != nil {
+		return err
+	}
+
+	ls, ok := lr.(app.Lister)
+	if !ok {
+		return errors.New(errorListUnsupported)
+	}
+
+	entries, err := ls.List()
+	if err != nil {
+		return err
+	}
+
+	ap := app.New(lr, nil, app.Config{})
+	enc := json.NewEncoder(os.Stdout)
+
+	count := 0
+	for _, entry := range entries {
+		for _, is := range check(ap, lr, entry) {
+			if err := enc.Encode(is); err != nil {
+				return err
+			}
+			count++
+		}
+	}
+
+	if count > 0 {
+		return fmt.Errorf(errorLintFailed, count)
+	}
+	return nil
+}
+
+func check(ap *app.App, lr app.Loader, entry app.Entry) []issue {
+	base := issue{File: entry.Source, Lang: entry.Lang, Name: entry.Name}
+
+	req := model.Request{TemplateLang: entry.Lang, TemplateName: entry.Name}
+
+	if *lintArgs.template.Samples != "" {
+		fname := path.Join(*lintArgs.template.Samples, entry.Lang, entry.Name+".json")
+
+		data, err := ioutil.ReadFile(fname)
+		if err != nil && !os.IsNotExist(err) {
+			base.Error = err.Error()
+			return []issue{base}
+		}
+
+		if err == nil {
+			if err := json.Unmarshal(data, &req.TemplateArgs); err != nil {
+				base.File = fname
+				base.Error = err.Error()
+				return []issue{base}
+			}
+		}
+	}
+
+	_, err := ap.Render(req)
+	if err == nil {
+		return nil
+	}
+
+	var errs validation.Errors
+	switch err.(type) {
+	case app.ArgumentError:
+		errs, _ = err.(app.ArgumentError).Err.(validation.Errors)
+	case app.TemplateError:
+		errs, _ = err.(app.TemplateError).Err.(validation.Errors)
+	}
+
+	if errs == nil {
+		base.Line = line(err.Error())
+		base.Error = err.Error()
+		return []issue{base}
+	}
+
+	text := source(lr, entry)
+
+	issues := []issue{}
+	for _, e := range decode(errs) {
+		is := base
+		is.Line = locate(text, e.Path)
+		is.Path = e.Path
+		is.Error = e.Error
+		is.Params = e.Params
+		issues = append(issues, is)
+	}
+	return issues
+}
+
+func decode(errs validation.Errors) []jsonError {
+	items := []jsonError{}
+	if err := json.Unmarshal([]byte(marshal(errs)), &items); err != nil {
+		return []jsonError{{Error: errs.Error()}}
+	}
+	return items
+}
+
+// line extracts the line number from template and YAML errors.
+func line(msg string) int {
+	for _, re := range []*regexp.Regexp{templateLine, yamlLine} {
+		if m := re.FindStringSubmatch(msg); m != nil {
+			if n, err := strconv.Atoi(m[1]); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+func source(lr app.Loader, entry app.Entry) []string {
+	r, err := lr.Load(entry.Lang, entry.Name)
+	if err != nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil
+	}
+
+	return strings.Split(string(data), "\n")
+}
+
+// locate finds the line of the YAML key addressed by the error path, e.g.
+// .From.Email, zero is returned if the key is not found.
+func locate(text []string, field string) int {
+	n, found := 0, 0
+	for _, key := range strings.Split(field, ".") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+
+		for ; n < len(text); n++ {
+			if defines(text[n], key) {
+				found = n + 1
+				break
+			}
+		}
+		if n == len(text) {
+			return found
+		}
+	}
+	return found
+}
+
+// defines reports whether the YAML line defines the key, as a mapping or as
+// the first key of a list item.
+func defines(line, key string) bool {
+	item := line[len(listItem.FindString(line)):]
+	if !strings.HasPrefix(item, key) {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimLeft(item[len(key):], " \t"), ":")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/app/loader/fs"
+)
+
+const lintBroken = `From:
+  Email: news@mail.com
+Subject: Hello {{.Username}!
+BodyType: text/plain
+---
+Hello!
+`
+
+const lintBrokenBody = `From:
+  Email: news@mail.com
+Subject: Hello
+BodyType: text/plain
+---
+Hello!
+
+Bye {{.Username}!
+`
+
+const lintBrokenText = `From:
+  Email: news@mail.com
+Subject: Hello
+BodyType: text/html
+---
+<p>Hello!</p>
+--- text
+Hello {{.Username}!
+`
+
+const lintInvalid = `From:
+  Email: news
+Subject: Hello
+BodyType: text/plain
+---
+Hello!
+`
+
+const lintValid = `From:
+  Email: news@mail.com
+Subject: Hello
+BodyType: text/plain
+---
+Hello!
+`
+
+func TestLint(t *testing.T) {
+	root, err := ioutil.TempDir("", "sendmail")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	files := map[string]string{
+		"broken":      lintBroken,
+		"broken-body": lintBrokenBody,
+		"broken-text": lintBrokenText,
+		"invalid":     lintInvalid,
+		"valid":       lintValid,
+	}
+	require.Nil(t, os.Mkdir(path.Join(root, "en"), 0755))
+	for name, text := range files {
+		require.Nil(t, ioutil.WriteFile(path.Join(root, "en", name+".msg"), []byte(text), 0644))
+	}
+
+	lr, err := fs.New(root)
+	require.Nil(t, err)
+	ap := app.New(lr, nil, app.Config{})
+
+	entry := func(name string) app.Entry {
+		return app.Entry{Lang: "en", Name: name, Source: path.Join(root, "en", name+".msg")}
+	}
+
+	t.Run("Broken", func(t *testing.T) {
+		issues := check(ap, lr, entry("broken"))
+		require.Len(t, issues, 1)
+		require.Equal(t, entry("broken").Source, issues[0].File)
+		require.Equal(t, 3, issues[0].Line)
+		require.Contains(t, issues[0].Error, "bad character")
+	})
+
+	t.Run("BrokenBody", func(t *testing.T) {
+		issues := check(ap, lr, entry("broken-body"))
+		require.Len(t, issues, 1)
+		require.Equal(t, 8, issues[0].Line)
+		require.Contains(t, issues[0].Error, "bad character")
+	})
+
+	t.Run("BrokenText", func(t *testing.T) {
+		issues := check(ap, lr, entry("broken-text"))
+		require.Len(t, issues, 1)
+		require.Equal(t, 8, issues[0].Line)
+		require.Contains(t, issues[0].Error, "bad character")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		issues := check(ap, lr, entry("invalid"))
+		require.Len(t, issues, 1)
+		require.Equal(t, 2, issues[0].Line)
+		require.Equal(t, ".From.Email", issues[0].Path)
+	})
+
+	t.Run("Valid", func(t *testing.T) {
+		require.Empty(t, check(ap, lr, entry("valid")))
+	})
+}
+
+func TestLine(t *testing.T) {
+	require.Equal(t, 7, line("template: en/welcome:7: unexpected EOF"))
+	require.Equal(t, 2, line("template: :2: bad character U+007D '}'"))
+	require.Equal(t, 4, line("yaml: line 4: did not find expected key"))
+	require.Equal(t, 0, line("template: :99999999999999999999: overflow"))
+	require.Equal(t, 0, line("cannot load template"))
+}
+
+func TestLocate(t *testing.T) {
+	text := []string{
+		"From:",
+		"  Email: news@mail.com",
+		"To:",
+		"  - Email: a@mail.com",
+		"  - Name: B",
+		"    Email: b",
+	}
+
+	require.Equal(t, 2, locate(text, ".From.Email"))
+	require.Equal(t, 4, locate(text, ".To.Email"))
+	require.Equal(t, 0, locate(text, ".Subject"))
+}
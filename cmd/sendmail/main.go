@@ -1,17 +1,26 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/akamensky/argparse"
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 
 	"github.com/vbogretsov/sendmail/api"
 	"github.com/vbogretsov/sendmail/app"
 	"github.com/vbogretsov/sendmail/app/loader"
 	"github.com/vbogretsov/sendmail/app/sender"
+	"github.com/vbogretsov/sendmail/app/sender/breaker"
+	"github.com/vbogretsov/sendmail/app/sender/retry"
+	"github.com/vbogretsov/sendmail/rest"
+	"github.com/vbogretsov/sendmail/rpc"
 )
 
 const (
@@ -22,31 +31,86 @@ const (
 var Version = ""
 
 const (
-	helpProviderName = "SMTP provider name [%v]"
-	helpProviderURL  = "SMTP provider API endpoint"
-	helpProviderKey  = "SMTP provider authorization key"
-	helpAMQPURL      = "AMQP brocker URL"
-	helpAMQPQName    = "AMQP quee listening name"
-	helpTemplatePath = "templates root location"
-	helpLogLevel     = "log level [%v]"
+	helpProviderName     = "SMTP provider name [%v], repeat to configure failover"
+	helpProviderURL      = "SMTP provider API endpoint, one per provider name"
+	helpProviderKey      = "SMTP provider authorization key, one per provider name"
+	helpProviderCooldown = "time a failed provider is skipped for"
+	helpRetryAttempts    = "maximum number of send attempts"
+	helpRetryDelay       = "delay before the first send retry"
+	helpRetryMaxDelay    = "maximum delay between send retries"
+	helpBreakerThreshold = "number of consecutive failures opening the circuit"
+	helpBreakerTimeout   = "time the circuit stays open"
+	helpAMQPURL          = "AMQP brocker URL"
+	helpAMQPQName        = "AMQP quee listening name"
+	helpAMQPRetryDelays  = "comma separated delays of failed requests retries"
+	helpAMQPWorkers      = "number of requests processed concurrently"
+	helpAMQPPrefetch     = "number of unacknowledged requests delivered ahead"
+	helpAMQPReconnect    = "delay before the first reconnection attempt"
+	helpAMQPReconnectMax = "maximum delay between reconnection attempts"
+	helpAMQPResults      = "AMQP exchange receiving every request outcome"
+	helpTemplatePath     = "templates root location, e.g. fs:///templates?watch=true&validate=true"
+	helpFallback         = "language used if a template is not available in the requested one"
+	helpCacheSize        = "maximum number of compiled templates cached, 0 disables cache, negative means unbounded"
+	helpCacheTTL         = "time a compiled template is cached for, 0 means forever"
+	helpDeriveText       = "derive plain text alternative of HTML bodies if templates lack one"
+	helpLogLevel         = "log level [%v]"
+	helpShutdownTimeout  = "time to wait for in-flight requests on shutdown"
+	helpAMQPDisable      = "do not consume requests from AMQP"
+	helpHTTPListen       = "HTTP API listen address, HTTP API is disabled if empty"
+	helpGRPCListen       = "gRPC API listen address, gRPC API is disabled if empty"
+)
+
+const (
+	errorProvidersMismatch = "each --provider-name requires --provider-url and --provider-key"
+	errorNothingToServe    = "AMQP, HTTP and gRPC APIs are disabled"
 )
 
 type argT struct {
 	provider struct {
-		Name *string
-		URL  *string
-		Key  *string
+		Name     *[]string
+		URL      *[]string
+		Key      *[]string
+		Cooldown *string
+	}
+	retry struct {
+		Attempts *int
+		Delay    *string
+		MaxDelay *string
+	}
+	breaker struct {
+		Threshold *int
+		Timeout   *string
 	}
 	amqp struct {
-		URL   *string
-		QName *string
+		URL          *string
+		QName        *string
+		RetryDelays  *string
+		Workers      *int
+		Prefetch     *int
+		Reconnect    *string
+		ReconnectMax *string
+		Results      *string
+		Disable      *bool
+	}
+	http struct {
+		Listen *string
+	}
+	grpc struct {
+		Listen *string
 	}
 	template struct {
-		Path *string
+		Path       *string
+		Fallback   *string
+		CacheSize  *int
+		CacheTTL   *string
+		DeriveText *bool
 	}
 	log struct {
 		Level *string
 	}
+	shutdown struct {
+		Timeout *string
+	}
 }
 
 var (
@@ -63,27 +127,75 @@ var (
 )
 
 func init() {
-	args.provider.Name = parser.String(
+	args.provider.Name = parser.List(
 		"",
 		"provider-name",
 		&argparse.Options{
 			Required: true,
 			Help:     fmt.Sprintf(helpProviderName, sender.Providers()),
 		})
-	args.provider.URL = parser.String(
+	args.provider.URL = parser.List(
 		"",
 		"provider-url",
 		&argparse.Options{
 			Required: true,
 			Help:     helpProviderURL,
 		})
-	args.provider.Key = parser.String(
+	args.provider.Key = parser.List(
 		"",
 		"provider-key",
 		&argparse.Options{
 			Required: true,
 			Help:     helpProviderKey,
 		})
+	args.provider.Cooldown = parser.String(
+		"",
+		"provider-cooldown",
+		&argparse.Options{
+			Required: false,
+			Default:  "1m",
+			Help:     helpProviderCooldown,
+		})
+	args.retry.Attempts = parser.Int(
+		"",
+		"retry-attempts",
+		&argparse.Options{
+			Required: false,
+			Default:  3,
+			Help:     helpRetryAttempts,
+		})
+	args.retry.Delay = parser.String(
+		"",
+		"retry-delay",
+		&argparse.Options{
+			Required: false,
+			Default:  "1s",
+			Help:     helpRetryDelay,
+		})
+	args.retry.MaxDelay = parser.String(
+		"",
+		"retry-max-delay",
+		&argparse.Options{
+			Required: false,
+			Default:  "30s",
+			Help:     helpRetryMaxDelay,
+		})
+	args.breaker.Threshold = parser.Int(
+		"",
+		"breaker-threshold",
+		&argparse.Options{
+			Required: false,
+			Default:  5,
+			Help:     helpBreakerThreshold,
+		})
+	args.breaker.Timeout = parser.String(
+		"",
+		"breaker-timeout",
+		&argparse.Options{
+			Required: false,
+			Default:  "30s",
+			Help:     helpBreakerTimeout,
+		})
 	args.template.Path = parser.String(
 		"",
 		"templates-path",
@@ -91,6 +203,36 @@ func init() {
 			Required: true,
 			Help:     helpTemplatePath,
 		})
+	args.template.Fallback = parser.String(
+		"",
+		"templates-fallback",
+		&argparse.Options{
+			Required: false,
+			Help:     helpFallback,
+		})
+	args.template.CacheSize = parser.Int(
+		"",
+		"templates-cache-size",
+		&argparse.Options{
+			Required: false,
+			Default:  256,
+			Help:     helpCacheSize,
+		})
+	args.template.CacheTTL = parser.String(
+		"",
+		"templates-cache-ttl",
+		&argparse.Options{
+			Required: false,
+			Default:  "5m",
+			Help:     helpCacheTTL,
+		})
+	args.template.DeriveText = parser.Flag(
+		"",
+		"templates-derive-text",
+		&argparse.Options{
+			Required: false,
+			Help:     helpDeriveText,
+		})
 	args.amqp.URL = parser.String(
 		"",
 		"amqp-url",
@@ -102,8 +244,84 @@ func init() {
 	args.amqp.QName = parser.String("", "amqp-qname", &argparse.Options{
 		Required: false,
 		Default:  name,
-		Help:     helpAMQPURL,
+		Help:     helpAMQPQName,
 	})
+	args.amqp.RetryDelays = parser.String(
+		"",
+		"amqp-retry-delays",
+		&argparse.Options{
+			Required: false,
+			Default:  "10s,1m,10m",
+			Help:     helpAMQPRetryDelays,
+		})
+	args.amqp.Workers = parser.Int(
+		"",
+		"amqp-workers",
+		&argparse.Options{
+			Required: false,
+			Default:  1,
+			Help:     helpAMQPWorkers,
+		})
+	args.amqp.Prefetch = parser.Int(
+		"",
+		"amqp-prefetch",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help:     helpAMQPPrefetch,
+		})
+	args.amqp.Reconnect = parser.String(
+		"",
+		"amqp-reconnect-delay",
+		&argparse.Options{
+			Required: false,
+			Default:  "1s",
+			Help:     helpAMQPReconnect,
+		})
+	args.amqp.ReconnectMax = parser.String(
+		"",
+		"amqp-reconnect-max-delay",
+		&argparse.Options{
+			Required: false,
+			Default:  "30s",
+			Help:     helpAMQPReconnectMax,
+		})
+	args.amqp.Results = parser.String(
+		"",
+		"amqp-results",
+		&argparse.Options{
+			Required: false,
+			Help:     helpAMQPResults,
+		})
+	args.amqp.Disable = parser.Flag(
+		"",
+		"amqp-disable",
+		&argparse.Options{
+			Required: false,
+			Help:     helpAMQPDisable,
+		})
+	args.http.Listen = parser.String(
+		"",
+		"http-listen",
+		&argparse.Options{
+			Required: false,
+			Help:     helpHTTPListen,
+		})
+	args.grpc.Listen = parser.String(
+		"",
+		"grpc-listen",
+		&argparse.Options{
+			Required: false,
+			Help:     helpGRPCListen,
+		})
+	args.shutdown.Timeout = parser.String(
+		"",
+		"shutdown-timeout",
+		&argparse.Options{
+			Required: false,
+			Default:  "30s",
+			Help:     helpShutdownTimeout,
+		})
 	args.log.Level = parser.Selector(
 		"",
 		"log-level",
@@ -115,6 +333,108 @@ func init() {
 		})
 }
 
+func providers() ([]sender.Config, error) {
+	names := *args.provider.Name
+	urls := *args.provider.URL
+	keys := *args.provider.Key
+
+	if len(urls) != len(names) || len(keys) != len(names) {
+		return nil, errors.New(errorProvidersMismatch)
+	}
+
+	configs := make([]sender.Config, len(names))
+	for i, name := range names {
+		configs[i] = sender.Config{Name: name, URL: urls[i], Key: keys[i]}
+	}
+
+	return configs, nil
+}
+
+func guard(sr app.Sender) (app.Sender, error) {
+	delay, err := time.ParseDuration(*args.retry.Delay)
+	if err != nil {
+		return nil, err
+	}
+
+	maxDelay, err := time.ParseDuration(*args.retry.MaxDelay)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := time.ParseDuration(*args.breaker.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := retry.New(sr, retry.Config{
+		Attempts: *args.retry.Attempts,
+		Delay:    delay,
+		MaxDelay: maxDelay,
+	})
+
+	return breaker.New(rt, *args.breaker.Threshold, timeout), nil
+}
+
+func cache() (*app.Cache, error) {
+	ttl, err := time.ParseDuration(*args.template.CacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	if *args.template.CacheSize == 0 {
+		return nil, nil
+	}
+
+	return app.NewCache(*args.template.CacheSize, ttl), nil
+}
+
+func durations(list string) ([]time.Duration, error) {
+	values := []time.Duration{}
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, d)
+	}
+	return values, nil
+}
+
+func apiConfig() (api.Config, error) {
+	delays, err := durations(*args.amqp.RetryDelays)
+	if err != nil {
+		return api.Config{}, err
+	}
+
+	reconnect, err := time.ParseDuration(*args.amqp.Reconnect)
+	if err != nil {
+		return api.Config{}, err
+	}
+
+	reconnectMax, err := time.ParseDuration(*args.amqp.ReconnectMax)
+	if err != nil {
+		return api.Config{}, err
+	}
+
+	cfg := api.Config{
+		URL:               *args.amqp.URL,
+		QName:             *args.amqp.QName,
+		Requeue:           true,
+		Delays:            delays,
+		Workers:           *args.amqp.Workers,
+		Prefetch:          *args.amqp.Prefetch,
+		ReconnectDelay:    reconnect,
+		ReconnectMaxDelay: reconnectMax,
+		Results:           *args.amqp.Results,
+	}
+
+	return cfg, nil
+}
+
 func run() error {
 	if err := parser.Parse(os.Args); err != nil {
 		return err
@@ -124,16 +444,40 @@ func run() error {
 	if err != nil {
 		return err
 	}
+	if cl, ok := lr.(io.Closer); ok {
+		defer cl.Close()
+	}
+
+	providers, err := providers()
+	if err != nil {
+		return err
+	}
+
+	cooldown, err := time.ParseDuration(*args.provider.Cooldown)
+	if err != nil {
+		return err
+	}
+
+	sr, err := sender.NewFailover(providers, cooldown)
+	if err != nil {
+		return err
+	}
 
-	sr, err := sender.New(
-		*args.provider.Name,
-		*args.provider.URL,
-		*args.provider.Key)
+	sr, err = guard(sr)
 	if err != nil {
 		return err
 	}
 
-	ap := app.New(lr, sr)
+	ch, err := cache()
+	if err != nil {
+		return err
+	}
+
+	ap := app.New(lr, sr, app.Config{
+		Cache:      ch,
+		Fallback:   *args.template.Fallback,
+		DeriveText: *args.template.DeriveText,
+	})
 
 	lv, err := log.ParseLevel(*args.log.Level)
 	if err != nil {
@@ -143,24 +487,100 @@ func run() error {
 
 	log.SetFormatter(&log.JSONFormatter{})
 
-	cn, err := amqp.Dial(*args.amqp.URL)
+	drain, err := time.ParseDuration(*args.shutdown.Timeout)
 	if err != nil {
 		return err
 	}
-	defer cn.Close()
 
-	cnt, err := api.New(ap, *args.amqp.QName, true, cn)
-	if err != nil {
-		return err
+	if *args.amqp.Disable && *args.http.Listen == "" && *args.grpc.Listen == "" {
+		return errors.New(errorNothingToServe)
 	}
-	defer cnt.Close()
 
-	cnt.Start()
-	return nil
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	var cnt *api.Api
+	var cntDone <-chan struct{}
+
+	if !*args.amqp.Disable {
+		cfg, err := apiConfig()
+		if err != nil {
+			return err
+		}
+
+		cnt, err = api.New(ap, cfg)
+		if err != nil {
+			return err
+		}
+		defer cnt.Close()
+
+		cntDone = cnt.Done()
+		go cnt.Start()
+	}
+
+	var srv *rest.Api
+	srvErr := make(chan error, 1)
+
+	if *args.http.Listen != "" {
+		srv = rest.New(ap, *args.http.Listen)
+		go func() {
+			srvErr <- srv.Start()
+		}()
+	}
+
+	var gsrv *rpc.Api
+	gsrvErr := make(chan error, 1)
+
+	if *args.grpc.Listen != "" {
+		gsrv = rpc.New(ap, *args.grpc.Listen)
+		go func() {
+			gsrvErr <- gsrv.Start()
+		}()
+	}
+
+	select {
+	case s := <-sig:
+		log.WithFields(log.Fields{
+			"signal": s.String(),
+		}).Info("shutting down")
+	case <-cntDone:
+	case err = <-srvErr:
+	case err = <-gsrvErr:
+	}
+
+	if cnt != nil {
+		if e := cnt.Shutdown(drain); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if srv != nil {
+		if e := srv.Shutdown(drain); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if gsrv != nil {
+		if e := gsrv.Shutdown(drain); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
 }
 
 func main() {
-	if err := run(); err != nil {
+	var err error
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == cmdRender:
+		err = render(os.Args[1:])
+	case len(os.Args) > 1 && os.Args[1] == cmdLint:
+		err = lint(os.Args[1:])
+	default:
+		err = run()
+	}
+
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/akamensky/argparse"
+	"github.com/vbogretsov/go-validation"
+	jsonerr "github.com/vbogretsov/go-validation/json"
+	"gopkg.in/yaml.v2"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/app/loader"
+	"github.com/vbogretsov/sendmail/model"
+)
+
+const (
+	cmdRender  = "render"
+	descRender = "render an email from a template without sending it"
+)
+
+const (
+	helpRenderLang   = "template language"
+	helpRenderName   = "template name"
+	helpRenderArgs   = "JSON file containing template arguments"
+	helpRenderFormat = "output format [%v]"
+)
+
+const (
+	formatYAML = "yaml"
+	formatJSON = "json"
+)
+
+type renderArgT struct {
+	template struct {
+		Path *string
+		Lang *string
+		Name *string
+		Args *string
+	}
+	Format *string
+}
+
+var (
+	renderArgs    = renderArgT{}
+	renderParser  = argparse.NewParser(fmt.Sprintf("%s %s", name, cmdRender), descRender)
+	renderFormats = []string{formatYAML, formatJSON}
+)
+
+func init() {
+	renderArgs.template.Path = renderParser.String(
+		"",
+		"templates-path",
+		&argparse.Options{
+			Required: true,
+			Help:     helpTemplatePath,
+		})
+	renderArgs.template.Lang = renderParser.String(
+		"",
+		"lang",
+		&argparse.Options{
+			Required: true,
+			Help:     helpRenderLang,
+		})
+	renderArgs.template.Name = renderParser.String(
+		"",
+		"name",
+		&argparse.Options{
+			Required: true,
+			Help:     helpRenderName,
+		})
+	renderArgs.template.Args = renderParser.String(
+		"",
+		"args",
+		&argparse.Options{
+			Required: false,
+			Help:     helpRenderArgs,
+		})
+	renderArgs.Format = renderParser.Selector(
+		"",
+		"format",
+		renderFormats,
+		&argparse.Options{
+			Required: false,
+			Default:  formatYAML,
+			Help:     fmt.Sprintf(helpRenderFormat, renderFormats),
+		})
+}
+
+// render prints the message built from the template, template and request
+// validation errors are reported in the same JSON format as the APIs use.
+func render(argv []string) error {
+	if err := renderParser.Parse(argv); err != nil {
+		return err
+	}
+
+	lr, err := loader.New(*renderArgs.template.Path)
+	if err != nil {
+		return err
+	}
+
+	req := model.Request{
+		TemplateLang: *renderArgs.template.Lang,
+		TemplateName: *renderArgs.template.Name,
+	}
+
+	if *renderArgs.template.Args != "" {
+		data, err := ioutil.ReadFile(*renderArgs.template.Args)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(data, &req.TemplateArgs); err != nil {
+			return err
+		}
+	}
+
+	msg, err := app.New(lr, nil, app.Config{}).Render(req)
+	if err != nil {
+		return describe(err)
+	}
+
+	var out []byte
+	switch *renderArgs.Format {
+	case formatJSON:
+		out, err = json.MarshalIndent(msg, "", "  ")
+		out = append(out, '\n')
+	default:
+		out, err = yaml.Marshal(msg)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+func describe(err error) error {
+	switch err.(type) {
+	case app.ArgumentError:
+		if errs, ok := err.(app.ArgumentError).Err.(validation.Errors); ok {
+			return fmt.Errorf("invalid request: %s", marshal(errs))
+		}
+	case app.TemplateError:
+		if errs, ok := err.(app.TemplateError).Err.(validation.Errors); ok {
+			return fmt.Errorf("invalid template: %s", marshal(errs))
+		}
+	}
+	return err
+}
+
+func marshal(errs validation.Errors) string {
+	data, err := json.Marshal(jsonerr.New(errs, jsonerr.DefaultFormatter, jsonerr.DefaultJoiner))
+	if err != nil {
+		return errs.Error()
+	}
+	return string(data)
+}
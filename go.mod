@@ -1,12 +1,15 @@
 module github.com/vbogretsov/sendmail
 
+go 1.21
+
 require (
-	github.com/akamensky/argparse v0.0.0-20180518035907-99676ba18cd5
+	github.com/akamensky/argparse v1.4.0
 	github.com/asaskevich/govalidator v0.0.0-20180720115003-f9ffefc3facf // indirect
 	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/labstack/gommon v0.2.1
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/sendgrid/rest v2.4.1+incompatible // indirect
+	github.com/sendgrid/rest v2.4.1+incompatible
 	github.com/sendgrid/sendgrid-go v3.4.1+incompatible
 	github.com/sirupsen/logrus v1.0.6
 	github.com/streadway/amqp v0.0.0-20180528204448-e5adc2ada8b8
@@ -15,6 +18,11 @@ require (
 	github.com/thanhpk/randstr v1.0.2
 	github.com/vbogretsov/go-validation v0.0.0-20180724144906-37bf9358f2ea
 	golang.org/x/crypto v0.0.0-20180723164146-c126467f60eb // indirect
-	golang.org/x/sys v0.0.0-20180724212812-e072cadbbdc8 // indirect
+	golang.org/x/net v0.25.0
+	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/text v0.15.0
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157
+	google.golang.org/grpc v1.65.0
+	google.golang.org/protobuf v1.34.2
 	gopkg.in/yaml.v2 v2.2.1
 )
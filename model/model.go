@@ -6,18 +6,51 @@ type Address struct {
 	Name  string `yaml:"Name" json:"name,omitempty"`
 }
 
-// Message represent an email message.
+// Attachment represents a file attached to an email. Content is the base64
+// encoded file content, alternatively Ref names an asset provided by the
+// templates loader, e.g. _assets/terms.pdf. Disposition is either attachment
+// or inline. Attachments with ContentID are inline images the HTML body
+// refers to as cid:<ContentID>.
+type Attachment struct {
+	Filename    string `yaml:"Filename" json:"filename"`
+	ContentType string `yaml:"ContentType" json:"contentType,omitempty"`
+	Content     string `yaml:"Content" json:"content,omitempty"`
+	Ref         string `yaml:"Ref" json:"ref,omitempty"`
+	Disposition string `yaml:"Disposition" json:"disposition,omitempty"`
+	ContentID   string `yaml:"ContentID" json:"contentId,omitempty"`
+}
+
+// Message represent an email message. Text is the plain text alternative of
+// an HTML body. Headers are additional email headers, Tags and Metadata are
+// passed to the provider to categorize and track the email. Lang is the
+// language of the template the message is built from.
 type Message struct {
-	From     Address   `yaml:"From"`
-	To       []Address `yaml:"To"`
-	Cc       []Address `yaml:"Cc"`
-	Bcc      []Address `yaml:"Bcc"`
-	Subject  string    `yaml:"Subject"`
-	BodyType string    `yaml:"BodyType"`
-	Body     string    `yaml:"Body"`
+	From        Address           `yaml:"From" json:"from"`
+	To          []Address         `yaml:"To" json:"to"`
+	Cc          []Address         `yaml:"Cc" json:"cc"`
+	Bcc         []Address         `yaml:"Bcc" json:"bcc"`
+	ReplyTo     []Address         `yaml:"ReplyTo" json:"replyTo,omitempty"`
+	Subject     string            `yaml:"Subject" json:"subject"`
+	BodyType    string            `yaml:"BodyType" json:"bodyType"`
+	Body        string            `yaml:"Body" json:"body"`
+	Text        string            `yaml:"Text" json:"text,omitempty"`
+	Attachments []Attachment      `yaml:"Attachments" json:"attachments,omitempty"`
+	Headers     map[string]string `yaml:"Headers" json:"headers,omitempty"`
+	Tags        []string          `yaml:"Tags" json:"tags,omitempty"`
+	Metadata    map[string]string `yaml:"Metadata" json:"metadata,omitempty"`
+	Lang        string            `yaml:"-" json:"lang,omitempty"`
+}
+
+// Receipt represents information about a sent email. Lang is the language
+// of the template the email is built from.
+type Receipt struct {
+	MessageID string `json:"messageId,omitempty"`
+	Lang      string `json:"lang,omitempty"`
 }
 
 // Request represents request parameters required to build and send an email.
+// ReplyTo replaces the reply addresses of the template, Headers and Metadata
+// are merged into the ones of the template, Tags are added to them.
 type Request struct {
 	TemplateLang string                 `json:"templateLang"`
 	TemplateName string                 `json:"templateName"`
@@ -25,4 +58,35 @@ type Request struct {
 	To           []Address              `json:"to"`
 	Cc           []Address              `json:"cc"`
 	Bcc          []Address              `json:"bcc"`
+	ReplyTo      []Address              `json:"replyTo,omitempty"`
+	Attachments  []Attachment           `json:"attachments,omitempty"`
+	Headers      map[string]string      `json:"headers,omitempty"`
+	Tags         []string               `json:"tags,omitempty"`
+	Metadata     map[string]string      `json:"metadata,omitempty"`
+}
+
+// Recipient represents a recipient of a batch, TemplateArgs personalize the
+// email sent to the recipient and override the arguments of the batch.
+// Metadata is merged into the metadata of the batch.
+type Recipient struct {
+	To           []Address              `json:"to"`
+	Cc           []Address              `json:"cc"`
+	Bcc          []Address              `json:"bcc"`
+	TemplateArgs map[string]interface{} `json:"templateArgs"`
+	Metadata     map[string]string      `json:"metadata,omitempty"`
+}
+
+// BatchRequest represents request parameters required to build and send an
+// email per recipient from the same template. The other parameters apply to
+// each email as in Request.
+type BatchRequest struct {
+	TemplateLang string                 `json:"templateLang"`
+	TemplateName string                 `json:"templateName"`
+	TemplateArgs map[string]interface{} `json:"templateArgs"`
+	Recipients   []Recipient            `json:"recipients"`
+	ReplyTo      []Address              `json:"replyTo,omitempty"`
+	Attachments  []Attachment           `json:"attachments,omitempty"`
+	Headers      map[string]string      `json:"headers,omitempty"`
+	Tags         []string               `json:"tags,omitempty"`
+	Metadata     map[string]string      `json:"metadata,omitempty"`
 }
@@ -0,0 +1,247 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/gommon/random"
+	log "github.com/sirupsen/logrus"
+	"github.com/vbogretsov/go-validation"
+	jsonerr "github.com/vbogretsov/go-validation/json"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+)
+
+const idsize = 32
+
+const (
+	pathMail        = "/v1/mail"
+	pathBatch       = "/v1/batch"
+	contentTypeJSON = "application/json"
+	maxBodySize     = 32 << 20
+)
+
+type response struct {
+	ID        string         `json:"id"`
+	MessageID string         `json:"messageId,omitempty"`
+	Lang      string         `json:"lang,omitempty"`
+	Errors    json.Marshaler `json:"errors,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// result represents an outcome of the email of a batch recipient, status is
+// the code the email would be responded with by POST /v1/mail.
+type result struct {
+	response
+	Status int `json:"status"`
+}
+
+type batchResponse struct {
+	ID      string         `json:"id"`
+	Results []result       `json:"results,omitempty"`
+	Errors  json.Marshaler `json:"errors,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// Api represents sendmail HTTP API.
+type Api struct {
+	ap     *app.App
+	server *http.Server
+}
+
+// New creates new Api listening on the address provided.
+func New(ap *app.App, addr string) *Api {
+	self := &Api{ap: ap}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(pathMail, self.sendmail)
+	mux.HandleFunc(pathBatch, self.sendbatch)
+
+	self.server = &http.Server{Addr: addr, Handler: mux}
+	return self
+}
+
+// Handler gets the API HTTP handler.
+func (self *Api) Handler() http.Handler {
+	return self.server.Handler
+}
+
+// Start starts listening for email requests, it blocks until Shutdown.
+func (self *Api) Start() error {
+	err := self.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops listening and waits until in-flight requests are processed
+// or the timeout expires.
+func (self *Api) Shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return self.server.Shutdown(ctx)
+}
+
+// sendmail handles POST /v1/mail. It responds 202 if the email is sent, 400
+// if the request is malformed or invalid, 422 if the template is broken or
+// produced an invalid message, 409 if the provider rejected the email and
+// 502 if the provider failed to send the email.
+func (self *Api) sendmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqid := random.String(idsize)
+	res := response{ID: reqid}
+
+	req := model.Request{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&req); err != nil {
+		log.WithFields(log.Fields{
+			"id":    reqid,
+			"error": err,
+		}).Error("malformed request")
+		res.Error = err.Error()
+		reply(w, http.StatusBadRequest, res)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"request": req,
+		"id":      reqid,
+	}).Debug("request received")
+
+	rc, err := self.ap.SendMail(req)
+	if err != nil {
+		reply(w, fail(reqid, &res, err), res)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"request":   req,
+		"id":        reqid,
+		"messageId": rc.MessageID,
+		"lang":      rc.Lang,
+	}).Debug("request completed")
+
+	res.MessageID = rc.MessageID
+	res.Lang = rc.Lang
+	reply(w, http.StatusAccepted, res)
+}
+
+// sendbatch handles POST /v1/batch. It responds 400 if the batch is
+// malformed or invalid, 422 or 502 if the batch fails as a whole the same
+// way as POST /v1/mail and 200 with a result per recipient otherwise.
+func (self *Api) sendbatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqid := random.String(idsize)
+	res := batchResponse{ID: reqid}
+
+	req := model.BatchRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&req); err != nil {
+		log.WithFields(log.Fields{
+			"id":    reqid,
+			"error": err,
+		}).Error("malformed batch")
+		res.Error = err.Error()
+		reply(w, http.StatusBadRequest, res)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":         reqid,
+		"recipients": len(req.Recipients),
+	}).Debug("batch received")
+
+	results, err := self.ap.SendBatch(req)
+	if ae, ok := err.(app.ArgumentError); ok {
+		res.Errors = marshal(ae.Errors())
+		log.WithFields(log.Fields{
+			"id":    reqid,
+			"error": res.Errors,
+		}).Error("invalid batch")
+		reply(w, http.StatusBadRequest, res)
+		return
+	} else if err != nil {
+		out := response{ID: reqid}
+		code := fail(reqid, &out, err)
+		res.Errors, res.Error = out.Errors, out.Error
+		reply(w, code, res)
+		return
+	}
+
+	res.Results = make([]result, len(results))
+	for n, br := range results {
+		out := result{response: response{ID: random.String(idsize)}}
+		if br.Err != nil {
+			out.Status = fail(out.ID, &out.response, br.Err)
+		} else {
+			out.Status = http.StatusAccepted
+			out.MessageID = br.Receipt.MessageID
+			out.Lang = br.Receipt.Lang
+		}
+		res.Results[n] = out
+	}
+
+	log.WithFields(log.Fields{
+		"id":         reqid,
+		"recipients": len(req.Recipients),
+	}).Debug("batch completed")
+
+	reply(w, http.StatusOK, res)
+}
+
+// fail logs the error, sets it to the response and gets the response code.
+func fail(reqid string, res *response, err error) int {
+	switch err.(type) {
+	case app.ArgumentError:
+		res.Errors = marshal(err.(app.ArgumentError).Errors())
+		log.WithFields(log.Fields{
+			"id":    reqid,
+			"error": res.Errors,
+		}).Error("invalid request")
+		return http.StatusBadRequest
+	case app.TemplateError:
+		res.Errors = marshal(err.(app.TemplateError).Errors())
+		log.WithFields(log.Fields{
+			"id":    reqid,
+			"error": res.Errors,
+		}).Error("invalid template")
+		return http.StatusUnprocessableEntity
+	case app.PermanentError:
+		log.WithFields(log.Fields{
+			"id":    reqid,
+			"error": err,
+		}).Error("email rejected")
+		res.Error = err.Error()
+		return http.StatusConflict
+	default:
+		log.WithFields(log.Fields{
+			"id":    reqid,
+			"error": err,
+		}).Error("unable to send email")
+		res.Error = err.Error()
+		return http.StatusBadGateway
+	}
+}
+
+func reply(w http.ResponseWriter, code int, res interface{}) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+func marshal(err validation.Errors) json.Marshaler {
+	return jsonerr.New(err, jsonerr.DefaultFormatter, jsonerr.DefaultJoiner)
+}
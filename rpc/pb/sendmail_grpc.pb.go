@@ -0,0 +1,253 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.27.1
+// source: sendmail.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Mailer_SendMail_FullMethodName         = "/sendmail.v1.Mailer/SendMail"
+	Mailer_SendBatch_FullMethodName        = "/sendmail.v1.Mailer/SendBatch"
+	Mailer_SendPersonalized_FullMethodName = "/sendmail.v1.Mailer/SendPersonalized"
+	Mailer_RenderPreview_FullMethodName    = "/sendmail.v1.Mailer/RenderPreview"
+)
+
+// MailerClient is the client API for Mailer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Mailer builds emails from templates and sends them.
+type MailerClient interface {
+	// SendMail builds an email from a template and sends it.
+	SendMail(ctx context.Context, in *MailRequest, opts ...grpc.CallOption) (*MailReply, error)
+	// SendBatch sends several emails, each request succeeds or fails
+	// independently.
+	SendBatch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchReply, error)
+	// SendPersonalized builds an email per recipient from the same template and
+	// sends them, each recipient succeeds or fails independently.
+	SendPersonalized(ctx context.Context, in *PersonalizedRequest, opts ...grpc.CallOption) (*BatchReply, error)
+	// RenderPreview builds an email from a template without sending it,
+	// recipients are optional.
+	RenderPreview(ctx context.Context, in *MailRequest, opts ...grpc.CallOption) (*Message, error)
+}
+
+type mailerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMailerClient(cc grpc.ClientConnInterface) MailerClient {
+	return &mailerClient{cc}
+}
+
+func (c *mailerClient) SendMail(ctx context.Context, in *MailRequest, opts ...grpc.CallOption) (*MailReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MailReply)
+	err := c.cc.Invoke(ctx, Mailer_SendMail_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailerClient) SendBatch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchReply)
+	err := c.cc.Invoke(ctx, Mailer_SendBatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailerClient) SendPersonalized(ctx context.Context, in *PersonalizedRequest, opts ...grpc.CallOption) (*BatchReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchReply)
+	err := c.cc.Invoke(ctx, Mailer_SendPersonalized_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailerClient) RenderPreview(ctx context.Context, in *MailRequest, opts ...grpc.CallOption) (*Message, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Message)
+	err := c.cc.Invoke(ctx, Mailer_RenderPreview_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MailerServer is the server API for Mailer service.
+// All implementations must embed UnimplementedMailerServer
+// for forward compatibility.
+//
+// Mailer builds emails from templates and sends them.
+type MailerServer interface {
+	// SendMail builds an email from a template and sends it.
+	SendMail(context.Context, *MailRequest) (*MailReply, error)
+	// SendBatch sends several emails, each request succeeds or fails
+	// independently.
+	SendBatch(context.Context, *BatchRequest) (*BatchReply, error)
+	// SendPersonalized builds an email per recipient from the same template and
+	// sends them, each recipient succeeds or fails independently.
+	SendPersonalized(context.Context, *PersonalizedRequest) (*BatchReply, error)
+	// RenderPreview builds an email from a template without sending it,
+	// recipients are optional.
+	RenderPreview(context.Context, *MailRequest) (*Message, error)
+	mustEmbedUnimplementedMailerServer()
+}
+
+// UnimplementedMailerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedMailerServer struct{}
+
+func (UnimplementedMailerServer) SendMail(context.Context, *MailRequest) (*MailReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendMail not implemented")
+}
+func (UnimplementedMailerServer) SendBatch(context.Context, *BatchRequest) (*BatchReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendBatch not implemented")
+}
+func (UnimplementedMailerServer) SendPersonalized(context.Context, *PersonalizedRequest) (*BatchReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendPersonalized not implemented")
+}
+func (UnimplementedMailerServer) RenderPreview(context.Context, *MailRequest) (*Message, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenderPreview not implemented")
+}
+func (UnimplementedMailerServer) mustEmbedUnimplementedMailerServer() {}
+func (UnimplementedMailerServer) testEmbeddedByValue()                {}
+
+// UnsafeMailerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MailerServer will
+// result in compilation errors.
+type UnsafeMailerServer interface {
+	mustEmbedUnimplementedMailerServer()
+}
+
+func RegisterMailerServer(s grpc.ServiceRegistrar, srv MailerServer) {
+	// If the following call pancis, it indicates UnimplementedMailerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Mailer_ServiceDesc, srv)
+}
+
+func _Mailer_SendMail_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MailRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailerServer).SendMail(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Mailer_SendMail_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailerServer).SendMail(ctx, req.(*MailRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mailer_SendBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailerServer).SendBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Mailer_SendBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailerServer).SendBatch(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mailer_SendPersonalized_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PersonalizedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailerServer).SendPersonalized(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Mailer_SendPersonalized_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailerServer).SendPersonalized(ctx, req.(*PersonalizedRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mailer_RenderPreview_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MailRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailerServer).RenderPreview(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Mailer_RenderPreview_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailerServer).RenderPreview(ctx, req.(*MailRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Mailer_ServiceDesc is the grpc.ServiceDesc for Mailer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Mailer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sendmail.v1.Mailer",
+	HandlerType: (*MailerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SendMail",
+			Handler:    _Mailer_SendMail_Handler,
+		},
+		{
+			MethodName: "SendBatch",
+			Handler:    _Mailer_SendBatch_Handler,
+		},
+		{
+			MethodName: "SendPersonalized",
+			Handler:    _Mailer_SendPersonalized_Handler,
+		},
+		{
+			MethodName: "RenderPreview",
+			Handler:    _Mailer_RenderPreview_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "sendmail.proto",
+}
@@ -0,0 +1,389 @@
+package rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/labstack/gommon/random"
+	log "github.com/sirupsen/logrus"
+	"github.com/vbogretsov/go-validation"
+	jsonerr "github.com/vbogretsov/go-validation/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+	"github.com/vbogretsov/sendmail/rpc/pb"
+)
+
+const idsize = 32
+
+const (
+	errorDrainTimeout   = "timed out waiting for in-flight requests"
+	errorInvalidRequest = "invalid request"
+	errorInvalidMessage = "invalid template"
+)
+
+// Api represents sendmail gRPC API.
+type Api struct {
+	addr   string
+	server *grpc.Server
+}
+
+// New creates new Api listening on the address provided.
+func New(ap *app.App, addr string) *Api {
+	self := &Api{addr: addr, server: grpc.NewServer()}
+	pb.RegisterMailerServer(self.server, &service{ap: ap})
+	return self
+}
+
+// Start starts listening for email requests, it blocks until Shutdown.
+func (self *Api) Start() error {
+	lis, err := net.Listen("tcp", self.addr)
+	if err != nil {
+		return err
+	}
+	return self.Serve(lis)
+}
+
+// Serve accepts email requests on the listener provided, it blocks until
+// Shutdown.
+func (self *Api) Serve(lis net.Listener) error {
+	err := self.server.Serve(lis)
+	if err == grpc.ErrServerStopped {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops listening and waits until in-flight requests are processed
+// or the timeout expires, remaining requests are cancelled.
+func (self *Api) Shutdown(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		self.server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		self.server.Stop()
+		return errors.New(errorDrainTimeout)
+	}
+}
+
+type service struct {
+	pb.UnimplementedMailerServer
+	ap *app.App
+}
+
+// SendMail builds an email from a template and sends it. Invalid requests
+// fail with INVALID_ARGUMENT and invalid templates fail with
+// FAILED_PRECONDITION, both carry Errors details. Send failures fail with
+// UNAVAILABLE if the request can be retried and with INTERNAL otherwise.
+func (self *service) SendMail(ctx context.Context, in *pb.MailRequest) (*pb.MailReply, error) {
+	reqid := random.String(idsize)
+
+	rc, err := self.sendmail(reqid, request(in))
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.MailReply{Id: reqid, MessageId: rc.MessageID, Lang: rc.Lang}, nil
+}
+
+// SendBatch sends each email of the batch, a failure of one email does not
+// affect the others.
+func (self *service) SendBatch(ctx context.Context, in *pb.BatchRequest) (*pb.BatchReply, error) {
+	out := &pb.BatchReply{Results: make([]*pb.BatchResult, len(in.Requests))}
+
+	for n, req := range in.Requests {
+		reqid := random.String(idsize)
+		res := &pb.BatchResult{Id: reqid}
+
+		rc, err := self.sendmail(reqid, request(req))
+		if err != nil {
+			res.Status = status.Convert(err).Proto()
+		} else {
+			res.Status = status.New(codes.OK, "").Proto()
+			res.MessageId = rc.MessageID
+			res.Lang = rc.Lang
+		}
+
+		out.Results[n] = res
+	}
+
+	return out, nil
+}
+
+// SendPersonalized builds an email per recipient and sends them. An invalid
+// batch fails as SendMail does, otherwise a result per recipient is returned
+// in the same order.
+func (self *service) SendPersonalized(ctx context.Context, in *pb.PersonalizedRequest) (*pb.BatchReply, error) {
+	reqid := random.String(idsize)
+	req := batch(in)
+
+	log.WithFields(log.Fields{
+		"id":         reqid,
+		"recipients": len(req.Recipients),
+	}).Debug("batch received")
+
+	results, err := self.ap.SendBatch(req)
+	if err != nil {
+		return nil, fail(reqid, err)
+	}
+
+	out := &pb.BatchReply{Results: make([]*pb.BatchResult, len(results))}
+	for n, br := range results {
+		res := &pb.BatchResult{Id: random.String(idsize)}
+		if br.Err != nil {
+			res.Status = status.Convert(fail(res.Id, br.Err)).Proto()
+		} else {
+			res.Status = status.New(codes.OK, "").Proto()
+			res.MessageId = br.Receipt.MessageID
+			res.Lang = br.Receipt.Lang
+		}
+		out.Results[n] = res
+	}
+
+	log.WithFields(log.Fields{
+		"id":         reqid,
+		"recipients": len(req.Recipients),
+	}).Debug("batch completed")
+
+	return out, nil
+}
+
+// RenderPreview builds an email from a template without sending it.
+func (self *service) RenderPreview(ctx context.Context, in *pb.MailRequest) (*pb.Message, error) {
+	reqid := random.String(idsize)
+	req := request(in)
+
+	log.WithFields(log.Fields{
+		"request": req,
+		"id":      reqid,
+	}).Debug("preview requested")
+
+	msg, err := self.ap.Render(req)
+	if err != nil {
+		return nil, fail(reqid, err)
+	}
+
+	return message(msg), nil
+}
+
+func (self *service) sendmail(reqid string, req model.Request) (model.Receipt, error) {
+	log.WithFields(log.Fields{
+		"request": req,
+		"id":      reqid,
+	}).Debug("request received")
+
+	rc, err := self.ap.SendMail(req)
+	if err != nil {
+		return rc, fail(reqid, err)
+	}
+
+	log.WithFields(log.Fields{
+		"request":   req,
+		"id":        reqid,
+		"messageId": rc.MessageID,
+		"lang":      rc.Lang,
+	}).Debug("request completed")
+
+	return rc, nil
+}
+
+// fail logs the error and converts it to a gRPC status error.
+func fail(reqid string, err error) error {
+	switch err.(type) {
+	case app.ArgumentError:
+		errs := err.(app.ArgumentError).Errors()
+		log.WithFields(log.Fields{
+			"id":    reqid,
+			"error": marshal(errs),
+		}).Error("invalid request")
+		return invalid(codes.InvalidArgument, errorInvalidRequest, errs)
+	case app.TemplateError:
+		errs := err.(app.TemplateError).Errors()
+		log.WithFields(log.Fields{
+			"id":    reqid,
+			"error": marshal(errs),
+		}).Error("invalid template")
+		return invalid(codes.FailedPrecondition, errorInvalidMessage, errs)
+	}
+
+	log.WithFields(log.Fields{
+		"id":    reqid,
+		"error": err,
+	}).Error("unable to send email")
+
+	if !app.IsTransient(err) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+// invalid creates a status error carrying validation errors as Errors
+// details in the same format as the HTTP and AMQP APIs report them.
+func invalid(code codes.Code, msg string, errs validation.Errors) error {
+	st := status.New(code, msg)
+
+	data, err := json.Marshal(marshal(errs))
+	if err != nil {
+		return st.Err()
+	}
+
+	items := []struct {
+		Path   string                 `json:"path"`
+		Error  string                 `json:"error"`
+		Params map[string]interface{} `json:"params"`
+	}{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return st.Err()
+	}
+
+	details := &pb.Errors{Errors: make([]*pb.Error, len(items))}
+	for n, item := range items {
+		details.Errors[n] = &pb.Error{Path: item.Path, Error: item.Error}
+		if item.Params != nil {
+			params, err := structpb.NewStruct(item.Params)
+			if err != nil {
+				return st.Err()
+			}
+			details.Errors[n].Params = params
+		}
+	}
+
+	if ds, err := st.WithDetails(details); err == nil {
+		st = ds
+	}
+	return st.Err()
+}
+
+func request(in *pb.MailRequest) model.Request {
+	return model.Request{
+		TemplateLang: in.TemplateLang,
+		TemplateName: in.TemplateName,
+		TemplateArgs: in.TemplateArgs.AsMap(),
+		To:           addresses(in.To),
+		Cc:           addresses(in.Cc),
+		Bcc:          addresses(in.Bcc),
+		ReplyTo:      addresses(in.ReplyTo),
+		Attachments:  attachments(in.Attachments),
+		Headers:      in.Headers,
+		Tags:         in.Tags,
+		Metadata:     in.Metadata,
+	}
+}
+
+func batch(in *pb.PersonalizedRequest) model.BatchRequest {
+	out := model.BatchRequest{
+		TemplateLang: in.TemplateLang,
+		TemplateName: in.TemplateName,
+		TemplateArgs: in.TemplateArgs.AsMap(),
+		ReplyTo:      addresses(in.ReplyTo),
+		Attachments:  attachments(in.Attachments),
+		Headers:      in.Headers,
+		Tags:         in.Tags,
+		Metadata:     in.Metadata,
+	}
+
+	for _, r := range in.Recipients {
+		out.Recipients = append(out.Recipients, model.Recipient{
+			To:           addresses(r.To),
+			Cc:           addresses(r.Cc),
+			Bcc:          addresses(r.Bcc),
+			TemplateArgs: r.TemplateArgs.AsMap(),
+			Metadata:     r.Metadata,
+		})
+	}
+
+	return out
+}
+
+func addresses(in []*pb.Address) []model.Address {
+	var out []model.Address
+	for _, a := range in {
+		out = append(out, model.Address{Email: a.Email, Name: a.Name})
+	}
+	return out
+}
+
+func attachments(in []*pb.Attachment) []model.Attachment {
+	var out []model.Attachment
+	for _, a := range in {
+		att := model.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Ref:         a.Ref,
+			Disposition: a.Disposition,
+			ContentID:   a.ContentId,
+		}
+		if len(a.Content) > 0 {
+			att.Content = base64.StdEncoding.EncodeToString(a.Content)
+		}
+		out = append(out, att)
+	}
+	return out
+}
+
+func message(msg model.Message) *pb.Message {
+	return &pb.Message{
+		From:        address(msg.From),
+		To:          pbaddresses(msg.To),
+		Cc:          pbaddresses(msg.Cc),
+		Bcc:         pbaddresses(msg.Bcc),
+		Subject:     msg.Subject,
+		BodyType:    msg.BodyType,
+		Body:        msg.Body,
+		Text:        msg.Text,
+		Lang:        msg.Lang,
+		Attachments: pbattachments(msg.Attachments),
+		ReplyTo:     pbaddresses(msg.ReplyTo),
+		Headers:     msg.Headers,
+		Tags:        msg.Tags,
+		Metadata:    msg.Metadata,
+	}
+}
+
+func address(a model.Address) *pb.Address {
+	return &pb.Address{Email: a.Email, Name: a.Name}
+}
+
+func pbaddresses(in []model.Address) []*pb.Address {
+	out := make([]*pb.Address, len(in))
+	for n, a := range in {
+		out[n] = address(a)
+	}
+	return out
+}
+
+// pbattachments converts the attachments of a built message, their content
+// is valid base64 at this point.
+func pbattachments(in []model.Attachment) []*pb.Attachment {
+	out := make([]*pb.Attachment, len(in))
+	for n, a := range in {
+		content, _ := base64.StdEncoding.DecodeString(a.Content)
+		out[n] = &pb.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Content:     content,
+			Ref:         a.Ref,
+			Disposition: a.Disposition,
+			ContentId:   a.ContentID,
+		}
+	}
+	return out
+}
+
+func marshal(err validation.Errors) json.Marshaler {
+	return jsonerr.New(err, jsonerr.DefaultFormatter, jsonerr.DefaultJoiner)
+}
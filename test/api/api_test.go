@@ -92,9 +92,9 @@ func TestApi(t *testing.T) {
 
 	lr := loader.New()
 	sd := sender.New()
-	ap := app.New(lr, sd)
+	ap := app.New(lr, sd, app.Config{})
 
-	cnt, err := api.New(ap, qname, false, conn)
+	cnt, err := api.New(ap, api.Config{URL: *amqpurl, QName: qname})
 	require.Nil(t, err)
 	defer cnt.Close()
 
@@ -138,6 +138,7 @@ func TestApi(t *testing.T) {
 			From:     model.Address{Email: "user@mail.com", Name: "Sender"},
 			BodyType: "text/plain",
 			Body:     fmt.Sprintf(loader.ExpectedBody, "SuperUser"),
+			Lang:     loader.Lang,
 			To:       req.To,
 			Cc:       []model.Address{},
 			Bcc:      []model.Address{},
@@ -166,4 +167,361 @@ func TestApi(t *testing.T) {
 		act := log.LastEntry().Data["error"].(error).Error()
 		require.Equal(t, exp, act)
 	})
+
+	t.Run("SendRejected", func(t *testing.T) {
+		log.Reset()
+		sd.Error = app.PermanentError{Err: errors.New("send rejected")}
+		defer func() {
+			sd.Error = nil
+		}()
+
+		err := cli.Send(defaultRequest)
+		require.Nil(t, err)
+
+		wait(func() bool {
+			return len(log.Entries) > 0
+		})
+
+		require.Len(t, log.Entries, 1)
+		require.Equal(t, "email rejected", log.LastEntry().Message)
+
+		exp := sd.Error.Error()
+		act := log.LastEntry().Data["error"].(error).Error()
+		require.Equal(t, exp, act)
+	})
+
+	t.Run("ReplySent", func(t *testing.T) {
+		reply, err := cli.Call(defaultRequest, timeout)
+		require.Nil(t, err)
+
+		res := struct {
+			Status        string `json:"status"`
+			CorrelationID string `json:"correlationId"`
+			MessageID     string `json:"messageId"`
+		}{}
+		require.Nil(t, json.Unmarshal(reply.Body, &res))
+
+		require.Equal(t, "sent", res.Status)
+		require.Equal(t, reply.CorrelationId, res.CorrelationID)
+		require.NotEmpty(t, res.MessageID)
+	})
+
+	t.Run("TemplateDeadLettered", func(t *testing.T) {
+		_, err := cli.DeadLetters()
+		require.Nil(t, err)
+
+		req := defaultRequest
+		req.TemplateName = loader.TemplateInvalidSyntax
+
+		reply, err := cli.Call(req, timeout)
+		require.Nil(t, err)
+
+		res := struct {
+			Status string `json:"status"`
+		}{}
+		require.Nil(t, json.Unmarshal(reply.Body, &res))
+		require.Equal(t, "failed", res.Status)
+
+		msgs, err := cli.DeadLetters()
+		require.Nil(t, err)
+		require.Len(t, msgs, 1)
+
+		exp, err := json.Marshal(req)
+		require.Nil(t, err)
+		require.Equal(t, exp, msgs[0].Body)
+	})
+
+	t.Run("BatchReplySent", func(t *testing.T) {
+		reply, err := cli.CallBatch(model.BatchRequest{
+			TemplateLang: defaultRequest.TemplateLang,
+			TemplateName: defaultRequest.TemplateName,
+			TemplateArgs: defaultRequest.TemplateArgs,
+			Recipients: []model.Recipient{
+				{To: defaultRequest.To},
+				{},
+			},
+		}, timeout)
+		require.Nil(t, err)
+
+		res := struct {
+			Status  string `json:"status"`
+			Results []struct {
+				Status    string `json:"status"`
+				MessageID string `json:"messageId"`
+			} `json:"results"`
+		}{}
+		require.Nil(t, json.Unmarshal(reply.Body, &res))
+
+		require.Equal(t, "partial", res.Status)
+		require.Len(t, res.Results, 2)
+		require.Equal(t, "sent", res.Results[0].Status)
+		require.NotEmpty(t, res.Results[0].MessageID)
+		require.Equal(t, "invalid", res.Results[1].Status)
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		require.Nil(t, cnt.Shutdown(timeout))
+
+		select {
+		case <-cnt.Done():
+		default:
+			t.Fatal("consumer is still running")
+		}
+	})
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	conn, err := amqp.Dial(*amqpurl)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	qname := qname + "-retry"
+
+	cli, err := client.New(conn, qname)
+	require.Nil(t, err)
+	defer cli.Close()
+
+	sd := sender.New()
+	sd.Error = errors.New("send failed")
+	ap := app.New(loader.New(), sd, app.Config{})
+
+	cnt, err := api.New(ap, api.Config{
+		URL:    *amqpurl,
+		QName:  qname,
+		Delays: []time.Duration{time.Millisecond * 10, time.Millisecond * 10},
+	})
+	require.Nil(t, err)
+	defer cnt.Close()
+
+	go func() {
+		cnt.Start()
+	}()
+
+	_, err = cli.DeadLetters()
+	require.Nil(t, err)
+
+	require.Nil(t, cli.Send(defaultRequest))
+
+	msgs := []amqp.Delivery{}
+	require.Nil(t, wait(func() bool {
+		msgs, err = cli.DeadLetters()
+		return err != nil || len(msgs) > 0
+	}))
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, int32(2), msgs[0].Headers["x-sendmail-attempt"])
+}
+
+func TestBatchRetriesExhausted(t *testing.T) {
+	conn, err := amqp.Dial(*amqpurl)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	qname := qname + "-batch"
+
+	cli, err := client.New(conn, qname)
+	require.Nil(t, err)
+	defer cli.Close()
+
+	lr := loader.New()
+	sd := sender.New()
+	sd.Failures = map[string]error{"b@mail.com": errors.New("send failed")}
+	ap := app.New(lr, sd, app.Config{})
+
+	cnt, err := api.New(ap, api.Config{
+		URL:    *amqpurl,
+		QName:  qname,
+		Delays: []time.Duration{time.Millisecond * 10},
+	})
+	require.Nil(t, err)
+	defer cnt.Close()
+
+	go func() {
+		cnt.Start()
+	}()
+	defer cnt.Shutdown(timeout)
+
+	_, err = cli.DeadLetters()
+	require.Nil(t, err)
+
+	req := model.BatchRequest{
+		TemplateLang: defaultRequest.TemplateLang,
+		TemplateName: defaultRequest.TemplateName,
+		TemplateArgs: defaultRequest.TemplateArgs,
+		Recipients: []model.Recipient{
+			{To: []model.Address{{Email: "a@mail.com"}}},
+			{To: []model.Address{{Email: "b@mail.com"}}},
+		},
+	}
+
+	reply, err := cli.CallBatch(req, timeout)
+	require.Nil(t, err)
+
+	res := struct {
+		Status  string `json:"status"`
+		Results []struct {
+			Status string `json:"status"`
+		} `json:"results"`
+	}{}
+	require.Nil(t, json.Unmarshal(reply.Body, &res))
+
+	require.Equal(t, "failed", res.Status)
+	require.Len(t, res.Results, 1)
+
+	require.Len(t, sd.Inbox, 1)
+	require.Equal(t, "a@mail.com", sd.Inbox[0].To[0].Email)
+
+	msgs, err := cli.DeadLetters()
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+
+	parked := model.BatchRequest{}
+	require.Nil(t, json.Unmarshal(msgs[0].Body, &parked))
+	require.Equal(t, req.Recipients[1:], parked.Recipients)
+}
+
+// blocking is a sender blocking until released.
+type blocking struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blocking) Send(msg model.Message) (string, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return "1", nil
+}
+
+func TestWorkers(t *testing.T) {
+	const workers = 3
+	const requests = 5
+
+	conn, err := amqp.Dial(*amqpurl)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	qname := qname + "-workers"
+
+	ch, err := conn.Channel()
+	require.Nil(t, err)
+	defer ch.Close()
+
+	cli, err := client.New(conn, qname)
+	require.Nil(t, err)
+	defer cli.Close()
+
+	sd := &blocking{
+		started: make(chan struct{}, requests),
+		release: make(chan struct{}),
+	}
+	ap := app.New(loader.New(), sd, app.Config{})
+
+	cnt, err := api.New(ap, api.Config{
+		URL:      *amqpurl,
+		QName:    qname,
+		Workers:  workers,
+		Prefetch: workers,
+	})
+	require.Nil(t, err)
+	defer cnt.Close()
+
+	_, err = ch.QueuePurge(qname, false)
+	require.Nil(t, err)
+
+	go func() {
+		cnt.Start()
+	}()
+	defer cnt.Shutdown(timeout)
+
+	for n := 0; n < requests; n++ {
+		require.Nil(t, cli.Send(defaultRequest))
+	}
+
+	for n := 0; n < workers; n++ {
+		select {
+		case <-sd.started:
+		case <-time.After(timeout):
+			t.Fatalf("%d of %d workers started", n, workers)
+		}
+	}
+
+	select {
+	case <-sd.started:
+		t.Fatal("more requests processed than workers")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	qe, err := ch.QueueInspect(qname)
+	require.Nil(t, err)
+	require.Equal(t, requests-workers, qe.Messages)
+
+	close(sd.release)
+
+	for n := workers; n < requests; n++ {
+		select {
+		case <-sd.started:
+		case <-time.After(timeout):
+			t.Fatalf("%d of %d requests processed", n, requests)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	conn, err := amqp.Dial(*amqpurl)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	qname := qname + "-reconnect"
+	results := qname + "-results"
+
+	ch, err := conn.Channel()
+	require.Nil(t, err)
+	defer ch.Close()
+
+	cli, err := client.New(conn, qname)
+	require.Nil(t, err)
+	defer cli.Close()
+
+	sd := sender.New()
+	ap := app.New(loader.New(), sd, app.Config{})
+
+	cnt, err := api.New(ap, api.Config{
+		URL:            *amqpurl,
+		QName:          qname,
+		Results:        results,
+		ReconnectDelay: time.Millisecond * 10,
+	})
+	require.Nil(t, err)
+	defer cnt.Close()
+
+	logrus.SetOutput(ioutil.Discard)
+	log := testhook.NewLocal(logrus.StandardLogger())
+
+	go func() {
+		cnt.Start()
+	}()
+	defer cnt.Shutdown(timeout)
+
+	reply, err := cli.Call(defaultRequest, timeout)
+	require.Nil(t, err)
+	require.NotEmpty(t, reply.Body)
+
+	// Publishing the result to a missing exchange closes the channel.
+	require.Nil(t, ch.ExchangeDelete(results, false, false))
+	require.Nil(t, cli.Send(defaultRequest))
+
+	reply, err = cli.Call(defaultRequest, timeout)
+	require.Nil(t, err)
+
+	res := struct {
+		Status string `json:"status"`
+	}{}
+	require.Nil(t, json.Unmarshal(reply.Body, &res))
+	require.Equal(t, "sent", res.Status)
+
+	reconnected := false
+	for _, e := range log.AllEntries() {
+		reconnected = reconnected || e.Message == "reconnected"
+	}
+	require.True(t, reconnected)
 }
@@ -2,7 +2,10 @@ package client
 
 import (
 	"encoding/json"
+	"errors"
+	"time"
 
+	"github.com/labstack/gommon/random"
 	"github.com/streadway/amqp"
 
 	"github.com/vbogretsov/sendmail/model"
@@ -37,6 +40,63 @@ func (s *Client) Send(req model.Request) error {
 	return s.channel.Publish(s.topic, s.topic, false, false, msg)
 }
 
+// Call sends the request and waits for the reply.
+func (s *Client) Call(req model.Request, timeout time.Duration) (amqp.Delivery, error) {
+	return s.call(req, "", timeout)
+}
+
+// CallBatch sends the batch request and waits for the reply.
+func (s *Client) CallBatch(req model.BatchRequest, timeout time.Duration) (amqp.Delivery, error) {
+	return s.call(req, "batch", timeout)
+}
+
+func (s *Client) call(req interface{}, typ string, timeout time.Duration) (amqp.Delivery, error) {
+	qe, err := s.channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	replies, err := s.channel.Consume(qe.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	msg := amqp.Publishing{
+		Body:          buf,
+		ReplyTo:       qe.Name,
+		CorrelationId: random.String(32),
+		Type:          typ,
+	}
+
+	if err := s.channel.Publish(s.topic, s.topic, false, false, msg); err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-time.After(timeout):
+		return amqp.Delivery{}, errors.New("reply timed out")
+	}
+}
+
+// DeadLetters takes the messages parked in the dead-letter queue.
+func (s *Client) DeadLetters() ([]amqp.Delivery, error) {
+	msgs := []amqp.Delivery{}
+	for {
+		msg, ok, err := s.channel.Get(s.topic+".dlq", true)
+		if err != nil || !ok {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
 func (s *Client) Close() error {
 	return s.channel.Close()
 }
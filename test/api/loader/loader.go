@@ -24,6 +24,7 @@ const (
 	TemplateMissingFrom      = "invalid-missing-from"
 	TemplateMissingFromEmail = "invalid-missing-from-email"
 	TemplateInvalidFromEmail = "invalid-from-email"
+	TemplateInvalidSyntax    = "invalid-syntax"
 )
 
 const msg = `
@@ -105,6 +106,14 @@ Body: |
   This is test body!
 `
 
+const msgInvalidSyntax = `
+From:
+  Email: user@mail.com
+Subject: Subject
+BodyType: "text/plain"
+Body: Hello {{.Username}!
+`
+
 type loader struct {
 	templates map[string]string
 }
@@ -119,6 +128,7 @@ func New() app.Loader {
 		fmt.Sprintf("%s-%s", Lang, TemplateMissingFrom):      msgMissingFrom,
 		fmt.Sprintf("%s-%s", Lang, TemplateMissingFromEmail): msgMissingFromEmail,
 		fmt.Sprintf("%s-%s", Lang, TemplateInvalidFromEmail): msgInvalidFromEmail,
+		fmt.Sprintf("%s-%s", Lang, TemplateInvalidSyntax):    msgInvalidSyntax,
 	}}
 }
 
@@ -130,3 +140,7 @@ func (self *loader) Load(lang, name string) (io.Reader, error) {
 	}
 	return strings.NewReader(text), nil
 }
+
+func (self *loader) LoadFile(lang, file string) (io.Reader, error) {
+	return self.Load(lang, file)
+}
@@ -1,6 +1,7 @@
 package sender
 
 import (
+	"strconv"
 	"sync"
 
 	"github.com/vbogretsov/sendmail/model"
@@ -10,19 +11,26 @@ type Sender struct {
 	mutex sync.Mutex
 	Inbox []model.Message
 	Error error
+	// Failures are the errors of the emails sent to the addresses provided.
+	Failures map[string]error
 }
 
 func New() *Sender {
 	return &Sender{Inbox: []model.Message{}}
 }
 
-func (self *Sender) Send(msg model.Message) error {
+func (self *Sender) Send(msg model.Message) (string, error) {
 	if self.Error != nil {
-		return self.Error
+		return "", self.Error
+	}
+
+	if len(msg.To) > 0 && self.Failures[msg.To[0].Email] != nil {
+		return "", self.Failures[msg.To[0].Email]
 	}
 
 	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
 	self.Inbox = append(self.Inbox, msg)
-	self.mutex.Unlock()
-	return nil
+	return strconv.Itoa(len(self.Inbox)), nil
 }
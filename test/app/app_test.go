@@ -0,0 +1,113 @@
+package app_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+
+	"github.com/vbogretsov/sendmail/test/api/loader"
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+var defaultRequest = model.Request{
+	TemplateLang: loader.Lang,
+	TemplateName: loader.TemplateValid,
+	TemplateArgs: map[string]interface{}{
+		"Username": "SuperUser",
+	},
+}
+
+var recipients = []model.Address{{Email: "to@mail.com"}}
+
+// discard is a sender dropping all messages.
+type discard struct{}
+
+func (discard) Send(msg model.Message) (string, error) {
+	return "", nil
+}
+
+// files is a loader of templates stored as lang/name.
+type files map[string]string
+
+func (self files) Load(lang, name string) (io.Reader, error) {
+	text, ok := self[path.Join(lang, name)]
+	if !ok {
+		return nil, errors.New("template not found")
+	}
+	return strings.NewReader(text), nil
+}
+
+func (self files) LoadFile(lang, file string) (io.Reader, error) {
+	return self.Load(lang, file)
+}
+
+func request(name string) model.Request {
+	req := defaultRequest
+	req.TemplateName = name
+	return req
+}
+
+func TestRender(t *testing.T) {
+	sd := sender.New()
+	ap := app.New(loader.New(), sd, app.Config{})
+
+	t.Run("WithoutRecipients", func(t *testing.T) {
+		msg, err := ap.Render(defaultRequest)
+		require.Nil(t, err)
+
+		exp := model.Message{
+			Subject:  "Subject",
+			From:     model.Address{Email: "user@mail.com", Name: "Sender"},
+			BodyType: "text/plain",
+			Body:     fmt.Sprintf(loader.ExpectedBody, "SuperUser"),
+			Lang:     loader.Lang,
+			To:       []model.Address{},
+			Cc:       []model.Address{},
+			Bcc:      []model.Address{},
+		}
+		require.Equal(t, exp, msg)
+		require.Empty(t, sd.Inbox)
+	})
+
+	t.Run("WithRecipients", func(t *testing.T) {
+		req := defaultRequest
+		req.To = []model.Address{{Email: "to@mail.com"}}
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, req.To, msg.To)
+		require.Empty(t, sd.Inbox)
+	})
+
+	t.Run("InvalidRecipient", func(t *testing.T) {
+		req := defaultRequest
+		req.To = []model.Address{{Email: "to.mail.com"}}
+
+		_, err := ap.Render(req)
+		require.IsType(t, app.ArgumentError{}, err)
+	})
+
+	t.Run("TemplateNotFound", func(t *testing.T) {
+		req := defaultRequest
+		req.TemplateName = "xxx"
+
+		_, err := ap.Render(req)
+		require.IsType(t, app.ArgumentError{}, err)
+	})
+
+	t.Run("InvalidTemplate", func(t *testing.T) {
+		req := defaultRequest
+		req.TemplateName = loader.TemplateMissingBody
+
+		_, err := ap.Render(req)
+		require.IsType(t, app.TemplateError{}, err)
+	})
+}
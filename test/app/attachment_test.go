@@ -0,0 +1,283 @@
+package app_test
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const attachmentInvoice = `From:
+  Email: user@mail.com
+Subject: Invoice {{.Number}}
+BodyType: text/plain
+Attachments:
+  - Filename: terms.pdf
+    Ref: _assets/terms.pdf
+---
+Invoice {{.Number}} attached.
+`
+
+const attachmentArgRef = `From:
+  Email: user@mail.com
+Subject: Invoice
+BodyType: text/plain
+Attachments:
+  - Filename: file.pdf
+    Ref: {{.Ref}}
+---
+Invoice attached.
+`
+
+const attachmentBranded = `From:
+  Email: user@mail.com
+Subject: News
+BodyType: text/html
+Attachments:
+  - Filename: logo.png
+    Ref: _assets/logo.png
+    ContentID: logo
+---
+<img src="{{cid "logo"}}" alt="ACME"><img src="cid:logo">
+`
+
+func encode(text string) string {
+	return base64.StdEncoding.EncodeToString([]byte(text))
+}
+
+func TestAttachment(t *testing.T) {
+	lr := files{
+		"en/invoice":           attachmentInvoice,
+		"en/argref":            attachmentArgRef,
+		"_assets/terms.pdf":    "shared terms",
+		"de/_assets/terms.pdf": "AGB",
+		"de/invoice":           attachmentInvoice,
+		"en/branded":           attachmentBranded,
+		"en/badcid":            `{{cid "a b"}}`,
+		"_assets/logo.png":     "PNG",
+	}
+
+	t.Run("TemplateAsset", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		msg, err := ap.Render(request("invoice"))
+		require.Nil(t, err)
+		require.Equal(t, []model.Attachment{
+			{
+				Filename:    "terms.pdf",
+				ContentType: "application/pdf",
+				Content:     encode("shared terms"),
+				Disposition: "attachment",
+			},
+		}, msg.Attachments)
+	})
+
+	t.Run("LanguageAsset", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		req := request("invoice")
+		req.TemplateLang = "de"
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Len(t, msg.Attachments, 1)
+		require.Equal(t, encode("AGB"), msg.Attachments[0].Content)
+	})
+
+	t.Run("RequestAttachments", func(t *testing.T) {
+		sd := sender.New()
+		ap := app.New(lr, sd, app.Config{})
+
+		req := request("invoice")
+		req.To = recipients
+		req.Attachments = []model.Attachment{
+			{
+				Filename:    "ticket.txt",
+				Content:     encode("ticket"),
+				Disposition: "inline",
+			},
+			{
+				Filename: "data",
+				Ref:      "_assets/terms.pdf",
+			},
+		}
+
+		_, err := ap.SendMail(req)
+		require.Nil(t, err)
+		require.Len(t, sd.Inbox, 1)
+		require.Equal(t, []model.Attachment{
+			{
+				Filename:    "terms.pdf",
+				ContentType: "application/pdf",
+				Content:     encode("shared terms"),
+				Disposition: "attachment",
+			},
+			{
+				Filename:    "ticket.txt",
+				ContentType: "text/plain; charset=utf-8",
+				Content:     encode("ticket"),
+				Disposition: "inline",
+			},
+			{
+				Filename:    "data",
+				ContentType: "application/octet-stream",
+				Content:     encode("shared terms"),
+				Disposition: "attachment",
+			},
+		}, sd.Inbox[0].Attachments)
+	})
+
+	t.Run("InlineImage", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		msg, err := ap.Render(request("branded"))
+		require.Nil(t, err)
+		require.Equal(t, `<img src="cid:logo" alt="ACME"><img src="cid:logo">`+"\n", msg.Body)
+		require.Equal(t, []model.Attachment{
+			{
+				Filename:    "logo.png",
+				ContentType: "image/png",
+				Content:     encode("PNG"),
+				Disposition: "inline",
+				ContentID:   "logo",
+			},
+		}, msg.Attachments)
+	})
+
+	t.Run("InvalidCID", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		_, err := ap.Render(request("badcid"))
+		require.NotNil(t, err)
+	})
+
+	t.Run("DuplicateContentID", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		req := request("branded")
+		req.To = recipients
+		req.Attachments = []model.Attachment{{
+			Filename:  "logo.png",
+			Content:   encode("PNG"),
+			ContentID: "logo",
+		}}
+
+		_, err := ap.SendMail(req)
+		require.IsType(t, app.TemplateError{}, err)
+	})
+
+	t.Run("MissingAsset", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		req := request("invoice")
+		req.To = recipients
+		req.Attachments = []model.Attachment{{
+			Filename: "missing.pdf",
+			Ref:      "_assets/missing.pdf",
+		}}
+
+		_, err := ap.SendMail(req)
+		require.IsType(t, app.ArgumentError{}, err)
+	})
+
+	t.Run("RefOutsideAssets", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		req := request("argref")
+		req.TemplateArgs = map[string]interface{}{"Ref": "_assets/../en/invoice"}
+
+		_, err := ap.Render(req)
+		require.IsType(t, app.TemplateError{}, err)
+	})
+
+	invalid := []struct {
+		name string
+		att  model.Attachment
+	}{
+		{
+			name: "MissingFilename",
+			att:  model.Attachment{Content: encode("x")},
+		},
+		{
+			name: "PathInFilename",
+			att:  model.Attachment{Filename: "../x.pdf", Content: encode("x")},
+		},
+		{
+			name: "CRLFInFilename",
+			att:  model.Attachment{Filename: "x.pdf\r\nBcc: a@mail.com", Content: encode("x")},
+		},
+		{
+			name: "MissingContent",
+			att:  model.Attachment{Filename: "x.pdf"},
+		},
+		{
+			name: "ContentAndRef",
+			att:  model.Attachment{Filename: "x.pdf", Content: encode("x"), Ref: "_assets/terms.pdf"},
+		},
+		{
+			name: "InvalidBase64",
+			att:  model.Attachment{Filename: "x.pdf", Content: "not base64!"},
+		},
+		{
+			name: "InvalidContentType",
+			att:  model.Attachment{Filename: "x.pdf", Content: encode("x"), ContentType: "pdf"},
+		},
+		{
+			name: "MultipartContentType",
+			att:  model.Attachment{Filename: "x.eml", Content: encode("x"), ContentType: "multipart/mixed"},
+		},
+		{
+			name: "InvalidDisposition",
+			att:  model.Attachment{Filename: "x.pdf", Content: encode("x"), Disposition: "form-data"},
+		},
+		{
+			name: "RefOutsideAssets",
+			att:  model.Attachment{Filename: "x.pdf", Ref: "en/invoice"},
+		},
+		{
+			name: "RefTraversal",
+			att:  model.Attachment{Filename: "x.pdf", Ref: "_assets/../../etc/passwd"},
+		},
+		{
+			name: "InvalidContentID",
+			att:  model.Attachment{Filename: "x.png", Content: encode("x"), ContentID: "<logo>"},
+		},
+		{
+			name: "BlockedExtension",
+			att:  model.Attachment{Filename: "setup.EXE", Content: encode("x")},
+		},
+		{
+			name: "BlockedContentType",
+			att:  model.Attachment{Filename: "x.txt", Content: encode("x"), ContentType: "application/x-msdownload"},
+		},
+		{
+			name: "BlockedContentTypeWithParams",
+			att:  model.Attachment{Filename: "x.txt", Content: encode("x"), ContentType: "text/javascript; charset=utf-8"},
+		},
+		{
+			name: "TooLarge",
+			att:  model.Attachment{Filename: "x.bin", Content: encode(strings.Repeat("x", 21<<20))},
+		},
+	}
+
+	for _, c := range invalid {
+		t.Run(c.name, func(t *testing.T) {
+			sd := sender.New()
+			ap := app.New(lr, sd, app.Config{})
+
+			req := request("invoice")
+			req.To = recipients
+			req.Attachments = []model.Attachment{c.att}
+
+			_, err := ap.SendMail(req)
+			require.IsType(t, app.ArgumentError{}, err)
+			require.Empty(t, sd.Inbox)
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package app_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const batchDigest = `From:
+  Email: news@mail.com
+Subject: {{.Title}} for {{.Name}}
+BodyType: text/plain
+Metadata:
+  campaign: weekly
+---
+Hello {{.Name}}, {{.Title}} is here.
+`
+
+const batchLogo = `From:
+  Email: news@mail.com
+Subject: News for {{.Name}}
+BodyType: text/plain
+Attachments:
+  - Filename: logo.png
+    Ref: _assets/logo.png
+---
+Hello {{.Name}}.
+`
+
+// batcher is a batch sender recording the batches sent.
+type batcher struct {
+	*sender.Sender
+	batches [][]model.Message
+}
+
+func (b *batcher) SendBatch(msgs []model.Message) ([]string, []error) {
+	b.batches = append(b.batches, msgs)
+	return app.Dispatch(b.Sender, msgs)
+}
+
+// batch builds the digest request for the recipients provided.
+func batch(recs ...model.Recipient) model.BatchRequest {
+	req := request("digest")
+	return model.BatchRequest{
+		TemplateLang: req.TemplateLang,
+		TemplateName: req.TemplateName,
+		TemplateArgs: map[string]interface{}{"Title": "Digest", "Name": "user"},
+		Recipients:   recs,
+		Metadata:     map[string]string{"batch": "1"},
+	}
+}
+
+func recipient(email, name string) model.Recipient {
+	return model.Recipient{
+		To:           []model.Address{{Email: email}},
+		TemplateArgs: map[string]interface{}{"Name": name},
+	}
+}
+
+func TestBatch(t *testing.T) {
+	lr := files{"en/digest": batchDigest}
+
+	t.Run("Personalized", func(t *testing.T) {
+		sd := &batcher{Sender: sender.New()}
+		ap := app.New(lr, sd, app.Config{})
+
+		rec := recipient("b@mail.com", "Bob")
+		rec.Metadata = map[string]string{"user": "2"}
+
+		results, err := ap.SendBatch(batch(
+			recipient("a@mail.com", "Alice"),
+			rec,
+			model.Recipient{To: []model.Address{{Email: "c@mail.com"}}},
+		))
+		require.Nil(t, err)
+		require.Equal(t, []app.BatchResult{
+			{Receipt: model.Receipt{MessageID: "1", Lang: "en"}},
+			{Receipt: model.Receipt{MessageID: "2", Lang: "en"}},
+			{Receipt: model.Receipt{MessageID: "3", Lang: "en"}},
+		}, results)
+
+		require.Len(t, sd.batches, 1)
+		require.Len(t, sd.Inbox, 3)
+		require.Equal(t, "Digest for Alice", sd.Inbox[0].Subject)
+		require.Equal(t, "Hello Bob, Digest is here.\n", sd.Inbox[1].Body)
+		require.Equal(t, "Digest for user", sd.Inbox[2].Subject)
+		require.Equal(t, map[string]string{
+			"campaign": "weekly",
+			"batch":    "1",
+			"user":     "2",
+		}, sd.Inbox[1].Metadata)
+		require.Equal(t, map[string]string{
+			"campaign": "weekly",
+			"batch":    "1",
+		}, sd.Inbox[0].Metadata)
+	})
+
+	t.Run("AttachmentsLoadedOnce", func(t *testing.T) {
+		lr := &counter{loader: files{"en/digest": batchDigest, "_assets/terms.pdf": "terms"}}
+		sd := sender.New()
+		ap := app.New(lr, sd, app.Config{Cache: app.NewCache(10, 0)})
+
+		req := batch(
+			recipient("a@mail.com", "Alice"),
+			recipient("b@mail.com", "Bob"),
+		)
+		req.Attachments = []model.Attachment{{Filename: "terms.pdf", Ref: "_assets/terms.pdf"}}
+
+		_, err := ap.SendBatch(req)
+		require.Nil(t, err)
+		// The template, then the asset looked up in en and in the shared language.
+		require.Equal(t, 3, lr.Loads)
+
+		require.Len(t, sd.Inbox, 2)
+		for _, msg := range sd.Inbox {
+			require.Equal(t, base64.StdEncoding.EncodeToString([]byte("terms")), msg.Attachments[0].Content)
+		}
+	})
+
+	t.Run("TemplateLoadedOnce", func(t *testing.T) {
+		lr := &counter{loader: files{"en/logo": batchLogo, "_assets/logo.png": "PNG"}}
+		sd := sender.New()
+		ap := app.New(lr, sd, app.Config{})
+
+		req := batch(
+			recipient("a@mail.com", "Alice"),
+			recipient("b@mail.com", "Bob"),
+			recipient("c@mail.com", "Carol"),
+		)
+		req.TemplateName = "logo"
+
+		_, err := ap.SendBatch(req)
+		require.Nil(t, err)
+		// The template, then the asset looked up in en and in the shared language.
+		require.Equal(t, 3, lr.Loads)
+
+		require.Len(t, sd.Inbox, 3)
+		for _, msg := range sd.Inbox {
+			require.Equal(t, base64.StdEncoding.EncodeToString([]byte("PNG")), msg.Attachments[0].Content)
+		}
+	})
+
+	t.Run("AttachmentNotFound", func(t *testing.T) {
+		sd := sender.New()
+		ap := app.New(lr, sd, app.Config{})
+
+		req := batch(recipient("a@mail.com", "Alice"))
+		req.Attachments = []model.Attachment{{Filename: "terms.pdf", Ref: "_assets/terms.pdf"}}
+
+		results, err := ap.SendBatch(req)
+		require.IsType(t, app.ArgumentError{}, err)
+		require.Nil(t, results)
+		require.Empty(t, sd.Inbox)
+	})
+
+	t.Run("SentOneByOne", func(t *testing.T) {
+		sd := sender.New()
+		ap := app.New(lr, sd, app.Config{})
+
+		results, err := ap.SendBatch(batch(
+			recipient("a@mail.com", "Alice"),
+			recipient("b@mail.com", "Bob"),
+		))
+		require.Nil(t, err)
+		require.Len(t, results, 2)
+		require.Len(t, sd.Inbox, 2)
+	})
+
+	t.Run("InvalidRecipient", func(t *testing.T) {
+		sd := &batcher{Sender: sender.New()}
+		ap := app.New(lr, sd, app.Config{})
+
+		results, err := ap.SendBatch(batch(
+			recipient("a@mail.com", "Alice"),
+			recipient("invalid", "Bob"),
+			model.Recipient{},
+		))
+		require.Nil(t, err)
+		require.Nil(t, results[0].Err)
+		require.IsType(t, app.ArgumentError{}, results[1].Err)
+		require.IsType(t, app.ArgumentError{}, results[2].Err)
+		require.Len(t, sd.batches, 1)
+		require.Len(t, sd.Inbox, 1)
+	})
+
+	t.Run("SendError", func(t *testing.T) {
+		sd := sender.New()
+		sd.Error = errors.New("unavailable")
+		ap := app.New(lr, sd, app.Config{})
+
+		results, err := ap.SendBatch(batch(recipient("a@mail.com", "Alice")))
+		require.Nil(t, err)
+		require.Equal(t, sd.Error, results[0].Err)
+	})
+
+	t.Run("NothingToSend", func(t *testing.T) {
+		sd := &batcher{Sender: sender.New()}
+		ap := app.New(lr, sd, app.Config{})
+
+		results, err := ap.SendBatch(batch(recipient("invalid", "Alice")))
+		require.Nil(t, err)
+		require.IsType(t, app.ArgumentError{}, results[0].Err)
+		require.Empty(t, sd.batches)
+	})
+
+	invalid := []struct {
+		name string
+		req  model.BatchRequest
+	}{
+		{
+			name: "MissingRecipients",
+			req:  batch(),
+		},
+		{
+			name: "TooManyRecipients",
+			req:  batch(make([]model.Recipient, 10001)...),
+		},
+		{
+			name: "MissingTemplateName",
+			req: model.BatchRequest{
+				TemplateLang: "en",
+				Recipients:   []model.Recipient{recipient("a@mail.com", "Alice")},
+			},
+		},
+		{
+			name: "InvalidTag",
+			req: model.BatchRequest{
+				TemplateLang: "en",
+				TemplateName: "digest",
+				Recipients:   []model.Recipient{recipient("a@mail.com", "Alice")},
+				Tags:         []string{""},
+			},
+		},
+	}
+
+	for _, c := range invalid {
+		t.Run(c.name, func(t *testing.T) {
+			sd := sender.New()
+			ap := app.New(lr, sd, app.Config{})
+
+			results, err := ap.SendBatch(c.req)
+			require.IsType(t, app.ArgumentError{}, err)
+			require.Nil(t, results)
+			require.Empty(t, sd.Inbox)
+		})
+	}
+}
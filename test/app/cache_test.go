@@ -0,0 +1,193 @@
+package app_test
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+
+	"github.com/vbogretsov/sendmail/test/api/loader"
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const cacheTemplate = `
+From:
+  Email: user@mail.com
+Subject: %s
+BodyType: "text/plain"
+Body: body
+`
+
+// counter counts templates loads.
+type counter struct {
+	mutex  sync.Mutex
+	loader app.Loader
+	Loads  int
+}
+
+func (self *counter) Load(lang, name string) (io.Reader, error) {
+	self.mutex.Lock()
+	self.Loads++
+	self.mutex.Unlock()
+	return self.loader.Load(lang, name)
+}
+
+func (self *counter) LoadFile(lang, file string) (io.Reader, error) {
+	self.mutex.Lock()
+	self.Loads++
+	self.mutex.Unlock()
+	return self.loader.LoadFile(lang, file)
+}
+
+func TestCache(t *testing.T) {
+	render := func(t *testing.T, ap *app.App, name string) {
+		req := defaultRequest
+		req.TemplateName = name
+
+		_, err := ap.Render(req)
+		require.Nil(t, err)
+	}
+
+	t.Run("Hit", func(t *testing.T) {
+		lr := &counter{loader: loader.New()}
+		ap := app.New(lr, sender.New(), app.Config{Cache: app.NewCache(10, 0)})
+
+		render(t, ap, loader.TemplateValid)
+		render(t, ap, loader.TemplateValid)
+		require.Equal(t, 1, lr.Loads)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		lr := &counter{loader: loader.New()}
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		render(t, ap, loader.TemplateValid)
+		render(t, ap, loader.TemplateValid)
+		require.Equal(t, 2, lr.Loads)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		lr := &counter{loader: loader.New()}
+		ap := app.New(lr, sender.New(), app.Config{Cache: app.NewCache(10, 10*time.Millisecond)})
+
+		render(t, ap, loader.TemplateValid)
+		time.Sleep(20 * time.Millisecond)
+		render(t, ap, loader.TemplateValid)
+		require.Equal(t, 2, lr.Loads)
+	})
+
+	t.Run("Evicted", func(t *testing.T) {
+		lr := &counter{loader: loader.New()}
+		ch := app.NewCache(1, 0)
+		ap := app.New(lr, sender.New(), app.Config{Cache: ch})
+
+		render(t, ap, loader.TemplateValid)
+		_, err := ap.Render(request(loader.TemplateMissingBody))
+		require.IsType(t, app.TemplateError{}, err)
+		require.Equal(t, 1, ch.Len())
+
+		render(t, ap, loader.TemplateValid)
+		require.Equal(t, 3, lr.Loads)
+	})
+
+	t.Run("ZeroSize", func(t *testing.T) {
+		lr := &counter{loader: loader.New()}
+		ch := app.NewCache(0, 0)
+		ap := app.New(lr, sender.New(), app.Config{Cache: ch})
+
+		render(t, ap, loader.TemplateValid)
+		render(t, ap, loader.TemplateValid)
+		require.Equal(t, 0, ch.Len())
+		require.Equal(t, 2, lr.Loads)
+	})
+
+	t.Run("Unbounded", func(t *testing.T) {
+		lr := &counter{loader: loader.New()}
+		ch := app.NewCache(-1, 0)
+		ap := app.New(lr, sender.New(), app.Config{Cache: ch})
+
+		render(t, ap, loader.TemplateValid)
+		_, err := ap.Render(request(loader.TemplateMissingBody))
+		require.IsType(t, app.TemplateError{}, err)
+
+		render(t, ap, loader.TemplateValid)
+		require.Equal(t, 2, ch.Len())
+		require.Equal(t, 2, lr.Loads)
+	})
+
+	t.Run("KeysDistinct", func(t *testing.T) {
+		lr := files{
+			"en-us/welcome": fmt.Sprintf(cacheTemplate, "A"),
+			"en/us-welcome": fmt.Sprintf(cacheTemplate, "B"),
+		}
+		ap := app.New(lr, sender.New(), app.Config{Cache: app.NewCache(10, 0)})
+
+		for _, fx := range []struct{ lang, name, subject string }{
+			{"en-us", "welcome", "A"},
+			{"en", "us-welcome", "B"},
+		} {
+			req := defaultRequest
+			req.TemplateLang = fx.lang
+			req.TemplateName = fx.name
+
+			msg, err := ap.Render(req)
+			require.Nil(t, err)
+			require.Equal(t, fx.subject, msg.Subject)
+		}
+	})
+
+	t.Run("Invalidate", func(t *testing.T) {
+		lr := &counter{loader: loader.New()}
+		ch := app.NewCache(10, 0)
+		ap := app.New(lr, sender.New(), app.Config{Cache: ch})
+
+		render(t, ap, loader.TemplateValid)
+		ch.Invalidate(loader.Lang, loader.TemplateValid)
+		require.Equal(t, 0, ch.Len())
+
+		render(t, ap, loader.TemplateValid)
+		require.Equal(t, 2, lr.Loads)
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		lr := &counter{loader: loader.New()}
+		ch := app.NewCache(10, 0)
+		ap := app.New(lr, sender.New(), app.Config{Cache: ch})
+
+		render(t, ap, loader.TemplateValid)
+		ch.Purge()
+		require.Equal(t, 0, ch.Len())
+
+		render(t, ap, loader.TemplateValid)
+		require.Equal(t, 2, lr.Loads)
+	})
+}
+
+func benchmarkSendMail(b *testing.B, ch *app.Cache) {
+	ap := app.New(loader.New(), discard{}, app.Config{Cache: ch})
+
+	req := defaultRequest
+	req.To = recipients
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		if _, err := ap.SendMail(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendMail(b *testing.B) {
+	benchmarkSendMail(b, nil)
+}
+
+func BenchmarkSendMailCached(b *testing.B) {
+	benchmarkSendMail(b, app.NewCache(10, time.Minute))
+}
@@ -0,0 +1,165 @@
+package app_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vbogretsov/go-validation"
+
+	"github.com/vbogretsov/sendmail/app"
+
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const unsafeName = `<script>alert("x")</script>`
+
+const escapedName = `&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;`
+
+var unsafeArgs = map[string]interface{}{"Username": unsafeName}
+
+const formatHTML = `From:
+  Email: user@mail.com
+Subject: Hello {{.Username}}
+BodyType: text/html
+---
+<p>Hello {{.Username}}!</p>
+<a href="https://mail.com/?user={{.Username}}">profile</a>
+`
+
+const formatText = `From:
+  Email: user@mail.com
+Subject: Hello
+BodyType: text/plain
+---
+Hello {{.Username}}!
+`
+
+const formatLegacyHTML = `
+From:
+  Email: user@mail.com
+Subject: Hello {{.Username}}
+BodyType: text/html
+Body: |
+  <p>Hello {{.Username}}!</p>
+`
+
+const formatLegacyStrip = `
+From:
+  Email: user@mail.com
+Body: |-
+  Hello {{.Username}}!
+
+    Bye!
+Subject: Hello
+BodyType: text/plain
+`
+
+const formatInlineHTML = `
+From:
+  Email: user@mail.com
+Subject: Hello
+BodyType: text/html
+Body: '<p>Hello {{.Username}}!</p>'
+`
+
+const formatInlineText = `
+From:
+  Email: user@mail.com
+Subject: Hello
+BodyType: text/plain
+Body: 'Hello {{.Username}}!'
+`
+
+const formatLayout = `From:
+  Email: user@mail.com
+Subject: Hello
+BodyType: text/html
+---
+{{define "content"}}<p>Hello {{.Username}}!</p>{{end}}
+{{- template "_layouts/mail.html" .}}`
+
+const formatLayoutMail = `<html><body>{{block "content" .}}{{end}}{{include "_partials/footer.html" .}}</body></html>`
+
+const formatLayoutFooter = `<p>Sent to {{.Username}}</p>`
+
+func TestFormat(t *testing.T) {
+	lr := files{
+		"en/html":               formatHTML,
+		"en/text":               formatText,
+		"en/legacy-html":        formatLegacyHTML,
+		"en/legacy-strip":       formatLegacyStrip,
+		"en/inline-html":        formatInlineHTML,
+		"en/inline-text":        formatInlineText,
+		"en/layout":             formatLayout,
+		"_layouts/mail.html":    formatLayoutMail,
+		"_partials/footer.html": formatLayoutFooter,
+	}
+	ap := app.New(lr, sender.New(), app.Config{})
+
+	t.Run("HTMLEscaped", func(t *testing.T) {
+		req := request("html")
+		req.TemplateArgs = unsafeArgs
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "Hello "+unsafeName, msg.Subject)
+		require.Equal(t, "<p>Hello "+escapedName+"!</p>\n"+
+			`<a href="https://mail.com/?user=%3cscript%3ealert%28%22x%22%29%3c%2fscript%3e">profile</a>`+"\n",
+			msg.Body)
+	})
+
+	t.Run("TextNotEscaped", func(t *testing.T) {
+		req := request("text")
+		req.TemplateArgs = unsafeArgs
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "Hello "+unsafeName+"!\n", msg.Body)
+	})
+
+	t.Run("LegacyHTMLEscaped", func(t *testing.T) {
+		req := request("legacy-html")
+		req.TemplateArgs = unsafeArgs
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "Hello "+unsafeName, msg.Subject)
+		require.Equal(t, "<p>Hello "+escapedName+"!</p>\n", msg.Body)
+	})
+
+	t.Run("LegacyStrip", func(t *testing.T) {
+		req := request("legacy-strip")
+		req.TemplateArgs = map[string]interface{}{"Username": "Bob"}
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "Hello", msg.Subject)
+		require.Equal(t, "text/plain", msg.BodyType)
+		require.Equal(t, "Hello Bob!\n\n  Bye!", msg.Body)
+	})
+
+	t.Run("InlineHTMLRejected", func(t *testing.T) {
+		_, err := ap.Render(request("inline-html"))
+		require.IsType(t, app.TemplateError{}, err)
+		require.Equal(t, app.ErrUnescapedBody, err.(app.TemplateError).Errors()[0].(validation.Error).Message)
+	})
+
+	t.Run("InlineText", func(t *testing.T) {
+		req := request("inline-text")
+		req.TemplateArgs = unsafeArgs
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "Hello "+unsafeName+"!", msg.Body)
+	})
+
+	t.Run("HTMLLayout", func(t *testing.T) {
+		req := request("layout")
+		req.TemplateArgs = unsafeArgs
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "<html><body><p>Hello "+escapedName+"!</p>"+
+			"<p>Sent to "+escapedName+"</p></body></html>", msg.Body)
+	})
+}
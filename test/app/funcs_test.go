@@ -0,0 +1,108 @@
+package app_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const funcsHeader = `From:
+  Email: user@mail.com
+Subject: Functions
+BodyType: `
+
+// expr renders the template expression provided in a text or HTML body.
+func expr(lang, bodyType, text string, args map[string]interface{}) (string, error) {
+	lr := files{lang + "/funcs": funcsHeader + bodyType + "\n---\n" + text}
+	ap := app.New(lr, sender.New(), app.Config{})
+
+	msg, err := ap.Render(model.Request{
+		TemplateLang: lang,
+		TemplateName: "funcs",
+		TemplateArgs: args,
+	})
+	return msg.Body, err
+}
+
+func TestFuncs(t *testing.T) {
+	args := map[string]interface{}{
+		"At":     "2018-07-24T14:49:06Z",
+		"Unix":   float64(1532443746),
+		"Amount": 1234.5,
+		"Count":  float64(3),
+		"Name":   "  jane doe  ",
+		"Empty":  "",
+		"Token":  "a b&c",
+	}
+
+	cases := []struct {
+		name string
+		lang string
+		text string
+		exp  string
+	}{
+		{name: "DateUTC", lang: "en", text: `{{date "2006-01-02 15:04" .At}}`, exp: "2018-07-24 14:49"},
+		{name: "DateZone", lang: "en", text: `{{date "2006-01-02 15:04 MST" .At "Europe/Moscow"}}`, exp: "2018-07-24 17:49 MSK"},
+		{name: "DateUnix", lang: "en", text: `{{date "2006-01-02" .Unix}}`, exp: "2018-07-24"},
+		{name: "NumberEn", lang: "en", text: `{{number .Amount}}`, exp: "1,234.5"},
+		{name: "NumberDe", lang: "de", text: `{{number .Amount}}`, exp: "1.234,5"},
+		{name: "NumberDigits", lang: "en", text: `{{number .Amount 2}}`, exp: "1,234.50"},
+		{name: "CurrencyEn", lang: "en", text: `{{currency "USD" .Amount}}`, exp: "$ 1,234.50"},
+		{name: "CurrencyPtBR", lang: "pt-BR", text: `{{currency "BRL" .Amount}}`, exp: "R$ 1.234,50"},
+		{name: "PluralEn", lang: "en", text: `{{.Count}} {{plural .Count "one" "file" "other" "files"}}`, exp: "3 files"},
+		{name: "PluralEnOne", lang: "en", text: `{{plural 1 "one" "file" "other" "files"}}`, exp: "file"},
+		{name: "PluralRuFew", lang: "ru", text: `{{plural .Count "one" "файл" "few" "файла" "many" "файлов" "other" "файла"}}`, exp: "файла"},
+		{name: "PluralRuMany", lang: "ru", text: `{{plural 5 "one" "файл" "few" "файла" "many" "файлов" "other" "файла"}}`, exp: "файлов"},
+		{name: "Upper", lang: "en", text: `{{upper "hi"}}`, exp: "HI"},
+		{name: "Lower", lang: "en", text: `{{lower "HI"}}`, exp: "hi"},
+		{name: "Title", lang: "en", text: `{{.Name | trim | title}}`, exp: "Jane Doe"},
+		{name: "Trim", lang: "en", text: `[{{trim .Name}}]`, exp: "[jane doe]"},
+		{name: "Truncate", lang: "en", text: `{{truncate 5 "Hello world"}}`, exp: "Hell…"},
+		{name: "TruncateShort", lang: "en", text: `{{truncate 20 "Hello"}}`, exp: "Hello"},
+		{name: "DefaultEmpty", lang: "en", text: `{{.Empty | default "friend"}}`, exp: "friend"},
+		{name: "DefaultMissing", lang: "en", text: `{{default "friend" .Missing}}`, exp: "friend"},
+		{name: "DefaultValue", lang: "en", text: `{{default "friend" "Bob"}}`, exp: "Bob"},
+		{name: "URL", lang: "en", text: `{{url "https://mail.com/reset" "token" .Token}}`, exp: "https://mail.com/reset?token=a+b%26c"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body, err := expr(c.lang, "text/plain", c.text, args)
+			require.Nil(t, err)
+			require.Equal(t, c.exp, body)
+		})
+	}
+
+	t.Run("Now", func(t *testing.T) {
+		body, err := expr("en", "text/plain", `{{date "2006" now}}`, args)
+		require.Nil(t, err)
+		require.Equal(t, time.Now().Format("2006"), body)
+	})
+
+	t.Run("URLInHTML", func(t *testing.T) {
+		body, err := expr("en", "text/html", `<a href="{{url "https://mail.com/reset" "token" .Token}}">reset</a>`, args)
+		require.Nil(t, err)
+		require.Equal(t, `<a href="https://mail.com/reset?token=a&#43;b%26c">reset</a>`, body)
+	})
+
+	t.Run("URLUnsafeScheme", func(t *testing.T) {
+		_, err := expr("en", "text/plain", `{{url "javascript:alert(1)"}}`, args)
+		require.NotNil(t, err)
+	})
+
+	t.Run("InvalidZone", func(t *testing.T) {
+		_, err := expr("en", "text/plain", `{{date "2006" .At "Mars/Base"}}`, args)
+		require.NotNil(t, err)
+	})
+
+	t.Run("InvalidCurrency", func(t *testing.T) {
+		_, err := expr("en", "text/plain", `{{currency "XXXX" .Amount}}`, args)
+		require.NotNil(t, err)
+	})
+}
@@ -0,0 +1,157 @@
+package app_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vbogretsov/go-validation"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const headersDigest = `From:
+  Email: news@mail.com
+ReplyTo:
+  - Email: support@mail.com
+Subject: Digest
+BodyType: text/plain
+Headers:
+  List-Unsubscribe: <https://mail.com/unsubscribe?user={{.Username}}>
+  X-Entity-Ref-ID: digest-{{.Username}}
+Tags:
+  - digest
+Metadata:
+  campaign: weekly
+---
+Weekly digest.
+`
+
+func TestHeaders(t *testing.T) {
+	lr := files{"en/digest": headersDigest}
+
+	t.Run("Template", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		msg, err := ap.Render(request("digest"))
+		require.Nil(t, err)
+		require.Equal(t, []model.Address{{Email: "support@mail.com"}}, msg.ReplyTo)
+		require.Equal(t, map[string]string{
+			"List-Unsubscribe": "<https://mail.com/unsubscribe?user=SuperUser>",
+			"X-Entity-Ref-ID":  "digest-SuperUser",
+		}, msg.Headers)
+		require.Equal(t, []string{"digest"}, msg.Tags)
+		require.Equal(t, map[string]string{"campaign": "weekly"}, msg.Metadata)
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		sd := sender.New()
+		ap := app.New(lr, sd, app.Config{})
+
+		req := request("digest")
+		req.To = recipients
+		req.ReplyTo = []model.Address{{Email: "owner@mail.com"}}
+		req.Headers = map[string]string{"x-entity-ref-id": "custom", "X-Priority": "1"}
+		req.Tags = []string{"digest", "weekly"}
+		req.Metadata = map[string]string{"campaign": "spring", "user": "42"}
+
+		_, err := ap.SendMail(req)
+		require.Nil(t, err)
+		require.Len(t, sd.Inbox, 1)
+
+		msg := sd.Inbox[0]
+		require.Equal(t, []model.Address{{Email: "owner@mail.com"}}, msg.ReplyTo)
+		require.Equal(t, map[string]string{
+			"List-Unsubscribe": "<https://mail.com/unsubscribe?user=SuperUser>",
+			"x-entity-ref-id":  "custom",
+			"X-Priority":       "1",
+		}, msg.Headers)
+		require.Equal(t, []string{"digest", "weekly"}, msg.Tags)
+		require.Equal(t, map[string]string{"campaign": "spring", "user": "42"}, msg.Metadata)
+	})
+
+	invalid := []struct {
+		name string
+		req  model.Request
+	}{
+		{
+			name: "InvalidReplyTo",
+			req:  model.Request{ReplyTo: []model.Address{{Email: "owner"}}},
+		},
+		{
+			name: "ReservedHeader",
+			req:  model.Request{Headers: map[string]string{"bcc": "spy@mail.com"}},
+		},
+		{
+			name: "InvalidHeaderName",
+			req:  model.Request{Headers: map[string]string{"X Priority": "1"}},
+		},
+		{
+			name: "HeaderInjection",
+			req:  model.Request{Headers: map[string]string{"X-Ref": "1\r\nBcc: spy@mail.com"}},
+		},
+		{
+			name: "EmptyTag",
+			req:  model.Request{Tags: []string{""}},
+		},
+		{
+			name: "TooManyTags",
+			req:  model.Request{Tags: strings.Split("a b c d e f g h i j k", " ")},
+		},
+		{
+			name: "MetadataInjection",
+			req:  model.Request{Metadata: map[string]string{"user": "1\n2"}},
+		},
+		{
+			name: "HeaderTooLong",
+			req:  model.Request{Headers: map[string]string{"X-Ref": strings.Repeat("a", 1000)}},
+		},
+		{
+			name: "MetadataTooLong",
+			req:  model.Request{Metadata: map[string]string{"user": strings.Repeat("a", 1000)}},
+		},
+	}
+
+	for _, c := range invalid {
+		t.Run(c.name, func(t *testing.T) {
+			sd := sender.New()
+			ap := app.New(lr, sd, app.Config{})
+
+			req := request("digest")
+			req.To = recipients
+			req.ReplyTo, req.Headers = c.req.ReplyTo, c.req.Headers
+			req.Tags, req.Metadata = c.req.Tags, c.req.Metadata
+
+			_, err := ap.SendMail(req)
+			require.IsType(t, app.ArgumentError{}, err)
+			require.Empty(t, sd.Inbox)
+		})
+	}
+
+	t.Run("FirstInvalidHeaderReported", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		req := request("digest")
+		req.To = recipients
+		req.Headers = map[string]string{"bcc": "spy@mail.com", "X Priority": "1", "Cc": "spy@mail.com"}
+
+		for n := 0; n < 10; n++ {
+			_, err := ap.SendMail(req)
+			require.IsType(t, app.ArgumentError{}, err)
+
+			e := err.(app.ArgumentError).Errors()[0].(validation.Error)
+			require.Equal(t, "Cc", e.Params["header"])
+		}
+	})
+
+	t.Run("ReservedTemplateHeader", func(t *testing.T) {
+		lr := files{"en/digest": strings.Replace(headersDigest, "X-Entity-Ref-ID", "Return-Path", 1)}
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		_, err := ap.Render(request("digest"))
+		require.IsType(t, app.TemplateError{}, err)
+	})
+}
@@ -0,0 +1,116 @@
+package app_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const langTemplate = `
+From:
+  Email: user@mail.com
+Subject: %s
+BodyType: "text/plain"
+Body: body
+`
+
+func TestFallback(t *testing.T) {
+	subjects := map[string]string{
+		"en":     "Welcome",
+		"pt":     "Bem-vindo",
+		"es-419": "Bienvenido",
+	}
+
+	lr := files{}
+	for lang, subject := range subjects {
+		lr[lang+"/welcome"] = fmt.Sprintf(langTemplate, subject)
+	}
+
+	cases := []struct {
+		name     string
+		lang     string
+		fallback string
+		used     string
+	}{
+		{name: "Exact", lang: "pt", used: "pt"},
+		{name: "Parent", lang: "pt-BR", used: "pt"},
+		{name: "Canonical", lang: "PT-br", used: "pt"},
+		{name: "Inheritance", lang: "es-AR", used: "es-419"},
+		{name: "Default", lang: "de-CH", fallback: "en", used: "en"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sd := sender.New()
+			ap := app.New(lr, sd, app.Config{Fallback: c.fallback})
+
+			req := request("welcome")
+			req.To = recipients
+			req.TemplateLang = c.lang
+
+			rc, err := ap.SendMail(req)
+			require.Nil(t, err)
+			require.Equal(t, c.used, rc.Lang)
+			require.Equal(t, c.used, sd.Inbox[0].Lang)
+			require.Equal(t, subjects[c.used], sd.Inbox[0].Subject)
+		})
+	}
+
+	t.Run("NotFound", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		req := request("welcome")
+		req.To = recipients
+		req.TemplateLang = "de-CH"
+
+		_, err := ap.SendMail(req)
+		require.IsType(t, app.ArgumentError{}, err)
+	})
+
+	t.Run("FormattedInUsedLanguage", func(t *testing.T) {
+		lr := files{"en/welcome": fmt.Sprintf(langTemplate, "Total {{number 1234.5}}")}
+		ap := app.New(lr, sender.New(), app.Config{Fallback: "en"})
+
+		req := request("welcome")
+		req.TemplateLang = "de-CH"
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "en", msg.Lang)
+		require.Equal(t, "Total 1,234.5", msg.Subject)
+	})
+
+	t.Run("Cached", func(t *testing.T) {
+		lr := files{"pt/welcome": fmt.Sprintf(langTemplate, "Bem-vindo")}
+		ch := app.NewCache(10, 0)
+		ap := app.New(lr, sender.New(), app.Config{Cache: ch})
+
+		req := request("welcome")
+		req.TemplateLang = "pt-BR"
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "pt", msg.Lang)
+		require.Equal(t, 1, ch.Len())
+
+		ch.Invalidate("pt", "welcome")
+		require.Equal(t, 0, ch.Len())
+
+		_, err = ap.Render(req)
+		require.Nil(t, err)
+
+		lr["pt-BR/welcome"] = fmt.Sprintf(langTemplate, "Bem-vinda")
+		ch.Invalidate("pt-BR", "welcome")
+		require.Equal(t, 0, ch.Len())
+
+		msg, err = ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "pt-BR", msg.Lang)
+		require.Equal(t, "Bem-vinda", msg.Subject)
+	})
+}
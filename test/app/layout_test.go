@@ -0,0 +1,122 @@
+package app_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const layoutBase = `From:
+  Email: user@mail.com
+Subject: {{block "subject" .}}Default{{end}}
+BodyType: text/plain
+Body: |
+{{include "body" . | indent 2}}
+{{include "_partials/footer.html" . | indent 2}}
+`
+
+const layoutWelcome = `{{define "subject"}}Welcome {{.Username}}{{end}}
+{{- define "body"}}Hello {{.Username}}!{{end}}
+{{- template "_layouts/base.html" .}}`
+
+const layoutPlain = `{{define "body"}}Hi{{end}}{{template "_layouts/base.html" .}}`
+
+func TestLayout(t *testing.T) {
+	lr := files{
+		"_layouts/base.html":       layoutBase,
+		"_partials/footer.html":    "--\nShared",
+		"en/_partials/footer.html": "--\nACME",
+		"en/welcome":               layoutWelcome,
+		"en/plain":                 layoutPlain,
+		"ru/welcome":               layoutWelcome,
+		"en/order.confirmed":       layoutWelcome,
+		"en/missing":               `{{template "_partials/missing.html" .}}`,
+	}
+
+	t.Run("LanguagePartial", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		msg, err := ap.Render(request("welcome"))
+		require.Nil(t, err)
+		require.Equal(t, "Welcome SuperUser", msg.Subject)
+		require.Equal(t, "Hello SuperUser!\n--\nACME\n", msg.Body)
+	})
+
+	t.Run("SharedPartial", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		req := request("welcome")
+		req.TemplateLang = "ru"
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "Hello SuperUser!\n--\nShared\n", msg.Body)
+	})
+
+	t.Run("DefaultBlock", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		msg, err := ap.Render(request("plain"))
+		require.Nil(t, err)
+		require.Equal(t, "Default", msg.Subject)
+		require.Equal(t, "Hi\n--\nACME\n", msg.Body)
+	})
+
+	t.Run("MissingPartial", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		_, err := ap.Render(request("missing"))
+		require.IsType(t, app.TemplateError{}, err)
+	})
+
+	t.Run("InvalidateCache", func(t *testing.T) {
+		ch := app.NewCache(10, 0)
+		ap := app.New(lr, sender.New(), app.Config{Cache: ch})
+
+		_, err := ap.Render(request("welcome"))
+		require.Nil(t, err)
+		_, err = ap.Render(request("missing"))
+		require.NotNil(t, err)
+		require.Equal(t, 1, ch.Len())
+
+		ch.Invalidate("", "_partials/footer.html")
+		require.Equal(t, 0, ch.Len())
+	})
+
+	t.Run("DottedName", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		msg, err := ap.Render(request("order.confirmed"))
+		require.Nil(t, err)
+		require.Equal(t, "Welcome SuperUser", msg.Subject)
+	})
+
+	invalid := []struct {
+		name string
+		lang string
+		tml  string
+	}{
+		{name: "Layout", lang: "en", tml: "_layouts/base.html"},
+		{name: "Partial", lang: "", tml: "_partials/footer.html"},
+		{name: "Traversal", lang: "en", tml: "../ru/welcome"},
+		{name: "Extension", lang: "en", tml: "welcome.html"},
+		{name: "LangTraversal", lang: "..", tml: "welcome"},
+		{name: "LangSeparator", lang: "en/_partials", tml: "footer"},
+	}
+
+	for _, c := range invalid {
+		t.Run(c.name, func(t *testing.T) {
+			ap := app.New(lr, sender.New(), app.Config{})
+
+			req := request(c.tml)
+			req.TemplateLang = c.lang
+
+			_, err := ap.Render(req)
+			require.IsType(t, app.ArgumentError{}, err)
+		})
+	}
+}
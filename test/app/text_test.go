@@ -0,0 +1,169 @@
+package app_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const textAlternative = `From:
+  Email: user@mail.com
+Subject: Hello
+BodyType: text/html
+---
+<p>Hello {{.Username}}!</p>
+--- text
+Hello {{.Username}}!
+`
+
+const textPlainAlternative = `From:
+  Email: user@mail.com
+Subject: Hello
+BodyType: text/plain
+---
+Hello {{.Username}}!
+--- text
+Hello {{.Username}}!
+`
+
+const textLegacy = `From:
+  Email: user@mail.com
+Subject: Hello
+BodyType: text/html
+Body: |
+  <p>Hello {{.Username}}!</p>
+Text: |
+  Hello {{.Username}}!
+`
+
+const textDerived = `From:
+  Email: user@mail.com
+Subject: Hello
+BodyType: text/html
+---
+<html>
+<head><title>Hello</title><style>p { color: red; }</style></head>
+<body>
+  <h1>Hello   {{.Username}}!</h1>
+  <p>Your order:<br>two items</p>
+  <ul><li>Book</li><li>Pen</li></ul>
+  <p>
+    <img src="cid:logo" alt="ACME">
+    <a href="https://mail.com/orders">Track order</a>
+    <a href="https://mail.com">https://mail.com</a>
+    <a href="mailto:help@mail.com">help@mail.com</a>
+  </p>
+  <script>alert("x")</script>
+</body>
+</html>
+`
+
+const textDerivedExpected = `Hello Bob!
+
+Your order:
+two items
+
+- Book
+- Pen
+
+ACME Track order (https://mail.com/orders) https://mail.com help@mail.com
+`
+
+func TestAlternative(t *testing.T) {
+	lr := files{
+		"en/alternative": textAlternative,
+		"en/plain":       textPlainAlternative,
+		"en/legacy":      textLegacy,
+		"en/derived":     textDerived,
+		"en/text":        formatText,
+	}
+
+	bob := map[string]interface{}{"Username": "Bob"}
+
+	t.Run("TextSection", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		req := request("alternative")
+		req.TemplateArgs = bob
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "<p>Hello Bob!</p>\n", msg.Body)
+		require.Equal(t, "Hello Bob!\n", msg.Text)
+	})
+
+	t.Run("TextNotEscaped", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		req := request("alternative")
+		req.TemplateArgs = unsafeArgs
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "Hello "+unsafeName+"!\n", msg.Text)
+	})
+
+	t.Run("LegacyText", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		req := request("legacy")
+		req.TemplateArgs = bob
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "<p>Hello Bob!</p>\n", msg.Body)
+		require.Equal(t, "Hello Bob!\n", msg.Text)
+	})
+
+	t.Run("TextRequiresHTML", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		_, err := ap.Render(request("plain"))
+		require.IsType(t, app.TemplateError{}, err)
+	})
+
+	t.Run("NotDerivedByDefault", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{})
+
+		req := request("derived")
+		req.TemplateArgs = bob
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Empty(t, msg.Text)
+	})
+
+	t.Run("Derived", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{DeriveText: true})
+
+		req := request("derived")
+		req.TemplateArgs = bob
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, textDerivedExpected, msg.Text)
+	})
+
+	t.Run("DefinedNotDerived", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{DeriveText: true})
+
+		req := request("alternative")
+		req.TemplateArgs = bob
+
+		msg, err := ap.Render(req)
+		require.Nil(t, err)
+		require.Equal(t, "Hello Bob!\n", msg.Text)
+	})
+
+	t.Run("PlainNotDerived", func(t *testing.T) {
+		ap := app.New(lr, sender.New(), app.Config{DeriveText: true})
+
+		msg, err := ap.Render(request("text"))
+		require.Nil(t, err)
+		require.Empty(t, msg.Text)
+	})
+}
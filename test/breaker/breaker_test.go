@@ -0,0 +1,103 @@
+package breaker_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app/sender/breaker"
+	"github.com/vbogretsov/sendmail/model"
+
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const (
+	threshold = 3
+	timeout   = time.Millisecond * 50
+)
+
+func send(br *breaker.Sender) error {
+	_, err := br.Send(model.Message{})
+	return err
+}
+
+func TestBreaker(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	sd := sender.New()
+	br := breaker.New(sd, threshold, timeout)
+
+	t.Run("ClosedByDefault", func(t *testing.T) {
+		require.Nil(t, send(br))
+		require.Equal(t, breaker.Closed, br.State())
+	})
+
+	t.Run("OpenAfterThresholdFailures", func(t *testing.T) {
+		sd.Error = errors.New("unavailable")
+
+		for i := 0; i < threshold; i++ {
+			require.Equal(t, sd.Error, send(br))
+		}
+		require.Equal(t, breaker.Open, br.State())
+
+		err := send(br)
+		require.IsType(t, breaker.OpenError{}, err)
+		require.True(t, err.(breaker.OpenError).RetryAfter() > 0)
+	})
+
+	t.Run("ReopenIfProbeFailed", func(t *testing.T) {
+		time.Sleep(timeout)
+		require.Equal(t, breaker.HalfOpen, br.State())
+
+		require.Equal(t, sd.Error, send(br))
+		require.Equal(t, breaker.Open, br.State())
+	})
+
+	t.Run("CloseIfProbeSucceeded", func(t *testing.T) {
+		sd.Error = nil
+		time.Sleep(timeout)
+
+		require.Nil(t, send(br))
+		require.Equal(t, breaker.Closed, br.State())
+	})
+}
+
+func TestBreakerBatch(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	sd := sender.New()
+	br := breaker.New(sd, 1, timeout)
+	msgs := []model.Message{{}, {}}
+
+	t.Run("FailedBatchCountsOnce", func(t *testing.T) {
+		sd.Error = errors.New("unavailable")
+
+		_, errs := br.SendBatch(msgs)
+		require.Equal(t, []error{sd.Error, sd.Error}, errs)
+		require.Equal(t, breaker.Open, br.State())
+	})
+
+	t.Run("FailFastIfOpen", func(t *testing.T) {
+		sd.Error = nil
+
+		_, errs := br.SendBatch(msgs)
+		require.Len(t, errs, 2)
+		for _, err := range errs {
+			require.IsType(t, breaker.OpenError{}, err)
+		}
+		require.Empty(t, sd.Inbox)
+	})
+
+	t.Run("CloseIfBatchSucceeded", func(t *testing.T) {
+		time.Sleep(timeout)
+
+		ids, errs := br.SendBatch(msgs)
+		require.Equal(t, []string{"1", "2"}, ids)
+		require.Equal(t, []error{nil, nil}, errs)
+		require.Equal(t, breaker.Closed, br.State())
+	})
+}
@@ -0,0 +1,159 @@
+package failover_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app/sender/failover"
+	"github.com/vbogretsov/sendmail/model"
+
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const cooldown = time.Millisecond * 100
+
+type permanentError struct{}
+
+func (permanentError) Error() string {
+	return "permanent"
+}
+
+func (permanentError) Temporary() bool {
+	return false
+}
+
+var defaultMessage = model.Message{
+	From:     model.Address{Email: "sender@mail.com"},
+	To:       []model.Address{{Email: "to@mail.com"}},
+	Subject:  "Subject",
+	BodyType: "text/plain",
+	Body:     "Body",
+}
+
+// rejecting fails the emails to the recipient with the error.
+type rejecting struct {
+	*sender.Sender
+	to  string
+	err error
+}
+
+func (r *rejecting) Send(msg model.Message) (string, error) {
+	if msg.To[0].Email == r.to {
+		return "", r.err
+	}
+	return r.Sender.Send(msg)
+}
+
+func send(fs *failover.Sender) error {
+	_, err := fs.Send(defaultMessage)
+	return err
+}
+
+func setup() (*failover.Sender, *sender.Sender, *sender.Sender) {
+	primary := sender.New()
+	secondary := sender.New()
+
+	fs := failover.New([]failover.Provider{
+		{Name: "primary", Sender: primary},
+		{Name: "secondary", Sender: secondary},
+	}, cooldown)
+
+	return fs, primary, secondary
+}
+
+func TestFailover(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	t.Run("SentViaFirstProvider", func(t *testing.T) {
+		fs, primary, secondary := setup()
+
+		id, err := fs.Send(defaultMessage)
+		require.Nil(t, err)
+		require.Equal(t, "1", id)
+		require.Len(t, primary.Inbox, 1)
+		require.Len(t, secondary.Inbox, 0)
+	})
+
+	t.Run("FallOverOnTransientError", func(t *testing.T) {
+		fs, primary, secondary := setup()
+		primary.Error = errors.New("unavailable")
+
+		require.Nil(t, send(fs))
+		require.Len(t, secondary.Inbox, 1)
+		require.Equal(t, []string{"secondary"}, fs.Healthy())
+	})
+
+	t.Run("SkipFailedProviderDuringCooldown", func(t *testing.T) {
+		fs, primary, secondary := setup()
+		primary.Error = errors.New("unavailable")
+
+		require.Nil(t, send(fs))
+		primary.Error = nil
+
+		require.Nil(t, send(fs))
+		require.Len(t, primary.Inbox, 0)
+		require.Len(t, secondary.Inbox, 2)
+
+		time.Sleep(cooldown)
+
+		require.Nil(t, send(fs))
+		require.Len(t, primary.Inbox, 1)
+		require.Equal(t, []string{"primary", "secondary"}, fs.Healthy())
+	})
+
+	t.Run("NoFallOverOnPermanentError", func(t *testing.T) {
+		fs, primary, secondary := setup()
+		primary.Error = permanentError{}
+
+		require.Equal(t, permanentError{}, send(fs))
+		require.Len(t, secondary.Inbox, 0)
+		require.Equal(t, []string{"primary", "secondary"}, fs.Healthy())
+	})
+
+	t.Run("ErrorIfAllProvidersFailed", func(t *testing.T) {
+		fs, primary, secondary := setup()
+		primary.Error = errors.New("unavailable")
+		secondary.Error = errors.New("unavailable")
+
+		err := send(fs)
+		require.IsType(t, failover.Error{}, err)
+		require.Len(t, err.(failover.Error).Errs, 2)
+		require.Equal(t,
+			"all providers are unavailable (primary: unavailable; secondary: unavailable)",
+			err.Error())
+		require.Empty(t, fs.Healthy())
+
+		err = send(fs)
+		require.IsType(t, failover.Error{}, err)
+		require.Len(t, err.(failover.Error).Errs, 0)
+	})
+
+	t.Run("BatchFallOverFailedEmailsOnly", func(t *testing.T) {
+		primary := &rejecting{Sender: sender.New(), to: "b@mail.com", err: errors.New("unavailable")}
+		secondary := &rejecting{Sender: sender.New()}
+
+		fs := failover.New([]failover.Provider{
+			{Name: "primary", Sender: primary},
+			{Name: "secondary", Sender: secondary},
+		}, cooldown)
+
+		msgs := []model.Message{}
+		for _, to := range []string{"a@mail.com", "b@mail.com", "c@mail.com"} {
+			msg := defaultMessage
+			msg.To = []model.Address{{Email: to}}
+			msgs = append(msgs, msg)
+		}
+
+		ids, errs := fs.SendBatch(msgs)
+		require.Equal(t, []string{"1", "1", "2"}, ids)
+		require.Equal(t, []error{nil, nil, nil}, errs)
+		require.Len(t, primary.Inbox, 2)
+		require.Len(t, secondary.Inbox, 1)
+		require.Equal(t, []string{"secondary"}, fs.Healthy())
+	})
+}
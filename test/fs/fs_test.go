@@ -0,0 +1,89 @@
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/app/loader/fs"
+)
+
+func write(t *testing.T, fname, text string) {
+	require.Nil(t, os.MkdirAll(path.Dir(fname), 0755))
+	require.Nil(t, ioutil.WriteFile(fname, []byte(text), 0644))
+}
+
+func TestList(t *testing.T) {
+	root, err := ioutil.TempDir("", "sendmail")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	write(t, path.Join(root, "en", "welcome.msg"), "Subject: Welcome")
+	write(t, path.Join(root, "en", "reset.msg"), "Subject: Reset")
+	write(t, path.Join(root, "en", "notes.txt"), "not a template")
+	write(t, path.Join(root, "ru", "welcome.msg"), "Subject: Welcome")
+	write(t, path.Join(root, "README"), "not a language")
+	write(t, path.Join(root, "_layouts", "base.html"), "layout")
+	write(t, path.Join(root, "en", "_partials", "footer.html"), "partial")
+
+	lr, err := fs.New(root)
+	require.Nil(t, err)
+
+	ls, ok := lr.(app.Lister)
+	require.True(t, ok)
+
+	entries, err := ls.List()
+	require.Nil(t, err)
+	require.Equal(t, []app.Entry{
+		{Lang: "en", Name: "reset", Source: path.Join(root, "en", "reset.msg")},
+		{Lang: "en", Name: "welcome", Source: path.Join(root, "en", "welcome.msg")},
+		{Lang: "ru", Name: "welcome", Source: path.Join(root, "ru", "welcome.msg")},
+	}, entries)
+}
+
+func TestListMissingRoot(t *testing.T) {
+	lr, err := fs.New("/nonexistent/sendmail/templates")
+	require.Nil(t, err)
+
+	_, err = lr.(app.Lister).List()
+	require.NotNil(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	root, err := ioutil.TempDir("", "sendmail")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	write(t, path.Join(root, "en", "order.confirmed.msg"), "Subject: Confirmed")
+	write(t, path.Join(root, "_layouts", "base.html"), "layout")
+
+	lr, err := fs.New(root)
+	require.Nil(t, err)
+
+	t.Run("NameWithDot", func(t *testing.T) {
+		r, err := lr.Load("en", "order.confirmed")
+		require.Nil(t, err)
+
+		text, err := ioutil.ReadAll(r)
+		require.Nil(t, err)
+		require.Equal(t, "Subject: Confirmed", string(text))
+	})
+
+	t.Run("FileNotTemplate", func(t *testing.T) {
+		_, err := lr.Load("", "_layouts/base.html")
+		require.NotNil(t, err)
+	})
+
+	t.Run("File", func(t *testing.T) {
+		r, err := lr.LoadFile("", "_layouts/base.html")
+		require.Nil(t, err)
+
+		text, err := ioutil.ReadAll(r)
+		require.Nil(t, err)
+		require.Equal(t, "layout", string(text))
+	})
+}
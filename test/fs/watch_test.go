@@ -0,0 +1,230 @@
+package fs_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/app/loader/fs"
+)
+
+const timeout = 2 * time.Second
+
+type change struct {
+	lang string
+	name string
+}
+
+// read loads the template or, if the name starts with underscore, the
+// layout, partial or asset.
+func read(t *testing.T, lr app.Loader, lang, name string) string {
+	load := lr.Load
+	if strings.HasPrefix(name, "_") {
+		load = lr.LoadFile
+	}
+
+	r, err := load(lang, name)
+	require.Nil(t, err)
+
+	text, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	return string(text)
+}
+
+func watch(t *testing.T, root, opts string) (app.Loader, chan change) {
+	lr, err := fs.New(root + opts)
+	require.Nil(t, err)
+
+	changes := make(chan change, 16)
+	lr.(app.Notifier).Notify(func(lang, name string) {
+		changes <- change{lang: lang, name: name}
+	})
+
+	return lr, changes
+}
+
+func wait(t *testing.T, changes chan change) change {
+	select {
+	case c := <-changes:
+		return c
+	case <-time.After(timeout):
+		t.Fatal("change not detected")
+	}
+	return change{}
+}
+
+// eventually waits until the template has the expected content.
+func eventually(t *testing.T, lr app.Loader, lang, name, exp string) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if read(t, lr, lang, name) == exp {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, exp, read(t, lr, lang, name))
+}
+
+// expect waits for the change provided skipping others, a file write may
+// produce several changes.
+func expect(t *testing.T, changes chan change, exp change) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case c := <-changes:
+			if c == exp {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("change %v not detected", exp)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	root, err := ioutil.TempDir("", "sendmail")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	fname := path.Join(root, "en", "welcome.msg")
+	write(t, fname, "Subject: v1")
+
+	t.Run("Reload", func(t *testing.T) {
+		lr, changes := watch(t, root, "?watch=true")
+		defer lr.(io.Closer).Close()
+
+		require.Equal(t, "Subject: v1", read(t, lr, "en", "welcome"))
+
+		write(t, fname, "Subject: v2")
+		require.Equal(t, change{lang: "en", name: "welcome"}, wait(t, changes))
+		eventually(t, lr, "en", "welcome", "Subject: v2")
+	})
+
+	t.Run("NewLanguage", func(t *testing.T) {
+		lr, changes := watch(t, root, "?watch=true")
+		defer lr.(io.Closer).Close()
+
+		require.Nil(t, os.Mkdir(path.Join(root, "ru"), 0755))
+		time.Sleep(100 * time.Millisecond)
+
+		write(t, path.Join(root, "ru", "welcome.msg"), "Subject: ru")
+		expect(t, changes, change{lang: "ru", name: "welcome"})
+		eventually(t, lr, "ru", "welcome", "Subject: ru")
+	})
+
+	t.Run("KeepLastGood", func(t *testing.T) {
+		write(t, fname, "Subject: good")
+
+		lr, changes := watch(t, root, "?watch=true&validate=true")
+		defer lr.(io.Closer).Close()
+
+		require.Equal(t, "Subject: good", read(t, lr, "en", "welcome"))
+
+		write(t, fname, "Subject: {{.Broken")
+		select {
+		case <-changes:
+			t.Fatal("invalid template swapped in")
+		case <-time.After(200 * time.Millisecond):
+		}
+		require.Equal(t, "Subject: good", read(t, lr, "en", "welcome"))
+
+		write(t, fname, "Subject: {{.Fixed}}")
+		wait(t, changes)
+		eventually(t, lr, "en", "welcome", "Subject: {{.Fixed}}")
+	})
+
+	t.Run("InvalidNotLoaded", func(t *testing.T) {
+		write(t, fname, "Subject: {{.Broken")
+
+		lr, changes := watch(t, root, "?watch=true&validate=true")
+		defer lr.(io.Closer).Close()
+
+		_, err := lr.Load("en", "welcome")
+		require.NotNil(t, err)
+
+		write(t, fname, "Subject: {{.Fixed}}")
+		wait(t, changes)
+		eventually(t, lr, "en", "welcome", "Subject: {{.Fixed}}")
+	})
+
+	t.Run("EmptyWriteIgnored", func(t *testing.T) {
+		write(t, fname, "Subject: v1")
+
+		lr, changes := watch(t, root, "?watch=true")
+		defer lr.(io.Closer).Close()
+
+		require.Equal(t, "Subject: v1", read(t, lr, "en", "welcome"))
+
+		write(t, fname, "")
+		select {
+		case <-changes:
+			t.Fatal("empty template swapped in")
+		case <-time.After(200 * time.Millisecond):
+		}
+		require.Equal(t, "Subject: v1", read(t, lr, "en", "welcome"))
+
+		write(t, fname, "Subject: v2")
+		wait(t, changes)
+		eventually(t, lr, "en", "welcome", "Subject: v2")
+	})
+
+	t.Run("InvalidateCache", func(t *testing.T) {
+		write(t, fname, "Subject: v1")
+
+		lr, changes := watch(t, root, "?watch=true")
+		defer lr.(io.Closer).Close()
+
+		ch := app.NewCache(10, 0)
+		app.New(lr, nil, app.Config{Cache: ch})
+
+		ch.Invalidate("en", "welcome")
+		write(t, path.Join(root, "en", "other.msg"), "Subject: other")
+		wait(t, changes)
+		require.Equal(t, 0, ch.Len())
+	})
+
+	t.Run("Partial", func(t *testing.T) {
+		write(t, path.Join(root, "_partials", "footer.html"), "v1")
+
+		lr, changes := watch(t, root, "?watch=true")
+		defer lr.(io.Closer).Close()
+
+		require.Equal(t, "v1", read(t, lr, "", "_partials/footer.html"))
+
+		write(t, path.Join(root, "en", "_partials", "footer.html"), "en")
+		expect(t, changes, change{lang: "en", name: "_partials/footer.html"})
+		eventually(t, lr, "en", "_partials/footer.html", "en")
+
+		write(t, path.Join(root, "_partials", "footer.html"), "v2")
+		expect(t, changes, change{lang: "", name: "_partials/footer.html"})
+		eventually(t, lr, "", "_partials/footer.html", "v2")
+	})
+
+	t.Run("AssetNotParsed", func(t *testing.T) {
+		write(t, path.Join(root, "_assets", "logo.png"), "\x89PNG{{")
+
+		lr, changes := watch(t, root, "?watch=true&validate=true")
+		defer lr.(io.Closer).Close()
+
+		require.Equal(t, "\x89PNG{{", read(t, lr, "", "_assets/logo.png"))
+
+		write(t, path.Join(root, "_assets", "logo.png"), "\x89PNG}}")
+		expect(t, changes, change{lang: "", name: "_assets/logo.png"})
+		eventually(t, lr, "", "_assets/logo.png", "\x89PNG}}")
+	})
+
+	t.Run("InvalidOption", func(t *testing.T) {
+		_, err := fs.New(root + "?watch=maybe")
+		require.NotNil(t, err)
+	})
+}
@@ -0,0 +1,227 @@
+package rest_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+	"github.com/vbogretsov/sendmail/rest"
+
+	"github.com/vbogretsov/sendmail/test/api/fixture"
+	"github.com/vbogretsov/sendmail/test/api/loader"
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const (
+	url      = "/v1/mail"
+	urlBatch = "/v1/batch"
+)
+
+var defaultRequest = model.Request{
+	TemplateLang: loader.Lang,
+	TemplateName: loader.TemplateValid,
+	TemplateArgs: map[string]interface{}{
+		"Username": "SuperUser",
+	},
+	To: []model.Address{
+		{
+			Email: "user@mail.com",
+		},
+	},
+}
+
+type response struct {
+	ID        string              `json:"id"`
+	MessageID string              `json:"messageId"`
+	Errors    []fixture.JsonError `json:"errors"`
+	Error     string              `json:"error"`
+}
+
+func post(t *testing.T, srv *httptest.Server, body []byte) (int, response) {
+	resp, err := http.Post(srv.URL+url, "application/json", bytes.NewReader(body))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	res := response{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+
+	return resp.StatusCode, res
+}
+
+func send(t *testing.T, srv *httptest.Server, req model.Request) (int, response) {
+	body, err := json.Marshal(req)
+	require.Nil(t, err)
+	return post(t, srv, body)
+}
+
+type batchResponse struct {
+	ID      string              `json:"id"`
+	Results []batchResult       `json:"results"`
+	Errors  []fixture.JsonError `json:"errors"`
+	Error   string              `json:"error"`
+}
+
+type batchResult struct {
+	response
+	Status int `json:"status"`
+}
+
+func sendBatch(t *testing.T, srv *httptest.Server, req model.BatchRequest) (int, batchResponse) {
+	body, err := json.Marshal(req)
+	require.Nil(t, err)
+
+	resp, err := http.Post(srv.URL+urlBatch, "application/json", bytes.NewReader(body))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	res := batchResponse{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+
+	return resp.StatusCode, res
+}
+
+func TestRest(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	sd := sender.New()
+	ap := app.New(loader.New(), sd, app.Config{})
+
+	srv := httptest.NewServer(rest.New(ap, "").Handler())
+	defer srv.Close()
+
+	for _, fx := range fixture.Fixtures {
+		t.Run(fx.Name, func(t *testing.T) {
+			code, res := send(t, srv, fx.Request)
+
+			require.Contains(t, []int{
+				http.StatusBadRequest,
+				http.StatusUnprocessableEntity,
+			}, code)
+			require.NotEmpty(t, res.ID)
+			require.Equal(t, fx.Errors, res.Errors)
+		})
+	}
+
+	t.Run("InvalidTemplate", func(t *testing.T) {
+		req := defaultRequest
+		req.TemplateName = loader.TemplateMissingSubject
+
+		code, _ := send(t, srv, req)
+		require.Equal(t, http.StatusUnprocessableEntity, code)
+	})
+
+	t.Run("MailSent", func(t *testing.T) {
+		code, res := send(t, srv, defaultRequest)
+
+		require.Equal(t, http.StatusAccepted, code)
+		require.NotEmpty(t, res.ID)
+		require.Equal(t, fmt.Sprint(len(sd.Inbox)), res.MessageID)
+
+		exp := model.Message{
+			Subject:  "Subject",
+			From:     model.Address{Email: "user@mail.com", Name: "Sender"},
+			BodyType: "text/plain",
+			Body:     fmt.Sprintf(loader.ExpectedBody, "SuperUser"),
+			Lang:     loader.Lang,
+			To:       defaultRequest.To,
+			Cc:       []model.Address{},
+			Bcc:      []model.Address{},
+		}
+		require.Equal(t, exp, sd.Inbox[len(sd.Inbox)-1])
+	})
+
+	t.Run("SendFailed", func(t *testing.T) {
+		sd.Error = errors.New("send failed")
+		defer func() {
+			sd.Error = nil
+		}()
+
+		code, res := send(t, srv, defaultRequest)
+		require.Equal(t, http.StatusBadGateway, code)
+		require.Equal(t, sd.Error.Error(), res.Error)
+	})
+
+	t.Run("BatchSent", func(t *testing.T) {
+		code, res := sendBatch(t, srv, model.BatchRequest{
+			TemplateLang: defaultRequest.TemplateLang,
+			TemplateName: defaultRequest.TemplateName,
+			TemplateArgs: defaultRequest.TemplateArgs,
+			Recipients: []model.Recipient{
+				{
+					To:           defaultRequest.To,
+					TemplateArgs: map[string]interface{}{"Username": "Bob"},
+				},
+				{},
+			},
+		})
+
+		require.Equal(t, http.StatusOK, code)
+		require.NotEmpty(t, res.ID)
+		require.Len(t, res.Results, 2)
+
+		require.Equal(t, http.StatusAccepted, res.Results[0].Status)
+		require.Equal(t, fmt.Sprint(len(sd.Inbox)), res.Results[0].MessageID)
+		require.Equal(t, fmt.Sprintf(loader.ExpectedBody, "Bob"), sd.Inbox[len(sd.Inbox)-1].Body)
+
+		require.Equal(t, http.StatusBadRequest, res.Results[1].Status)
+		require.Equal(t, []fixture.JsonError{
+			{Path: ".", Error: "missing recipients"},
+		}, res.Results[1].Errors)
+	})
+
+	t.Run("InvalidBatch", func(t *testing.T) {
+		code, res := sendBatch(t, srv, model.BatchRequest{
+			TemplateLang: defaultRequest.TemplateLang,
+			TemplateName: defaultRequest.TemplateName,
+		})
+
+		require.Equal(t, http.StatusBadRequest, code)
+		require.Empty(t, res.Results)
+		require.Equal(t, []fixture.JsonError{
+			{Path: ".recipients", Error: "missing recipients"},
+		}, res.Errors)
+	})
+
+	t.Run("BrokenTemplate", func(t *testing.T) {
+		req := defaultRequest
+		req.TemplateName = loader.TemplateInvalidSyntax
+
+		code, res := send(t, srv, req)
+		require.Equal(t, http.StatusUnprocessableEntity, code)
+		require.Len(t, res.Errors, 1)
+	})
+
+	t.Run("SendRejected", func(t *testing.T) {
+		sd.Error = app.PermanentError{Err: errors.New("rejected")}
+		defer func() {
+			sd.Error = nil
+		}()
+
+		code, res := send(t, srv, defaultRequest)
+		require.Equal(t, http.StatusConflict, code)
+		require.Equal(t, sd.Error.Error(), res.Error)
+	})
+
+	t.Run("MalformedRequest", func(t *testing.T) {
+		code, res := post(t, srv, []byte("{"))
+		require.Equal(t, http.StatusBadRequest, code)
+		require.NotEmpty(t, res.Error)
+	})
+
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + url)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
@@ -0,0 +1,135 @@
+package retry_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/app/sender/retry"
+	"github.com/vbogretsov/sendmail/model"
+)
+
+type permanentError struct{}
+
+func (permanentError) Error() string {
+	return "permanent"
+}
+
+func (permanentError) Temporary() bool {
+	return false
+}
+
+type flaky struct {
+	calls int
+	fails int
+	err   error
+}
+
+func (f *flaky) Send(msg model.Message) (string, error) {
+	f.calls++
+	if f.calls <= f.fails {
+		return "", f.err
+	}
+	return "id", nil
+}
+
+// recipients fails the emails to the recipients the number of times
+// configured.
+type recipients struct {
+	calls map[string]int
+	fails map[string]int
+}
+
+func (r *recipients) Send(msg model.Message) (string, error) {
+	to := msg.To[0].Email
+	r.calls[to]++
+	if r.calls[to] <= r.fails[to] {
+		return "", errors.New("unavailable")
+	}
+	return to, nil
+}
+
+var cfg = retry.Config{
+	Attempts: 3,
+	Delay:    time.Millisecond,
+	MaxDelay: time.Millisecond * 4,
+}
+
+func send(sd *flaky, cfg retry.Config) error {
+	_, err := retry.New(sd, cfg).Send(model.Message{})
+	return err
+}
+
+func TestRetry(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	t.Run("SentAfterTransientErrors", func(t *testing.T) {
+		sd := &flaky{fails: 2, err: errors.New("unavailable")}
+
+		require.Nil(t, send(sd, cfg))
+		require.Equal(t, 3, sd.calls)
+	})
+
+	t.Run("ErrorIfAttemptsExhausted", func(t *testing.T) {
+		sd := &flaky{fails: 5, err: errors.New("unavailable")}
+
+		require.Equal(t, sd.err, send(sd, cfg))
+		require.Equal(t, cfg.Attempts, sd.calls)
+	})
+
+	t.Run("NoRetryOnPermanentError", func(t *testing.T) {
+		sd := &flaky{fails: 5, err: permanentError{}}
+
+		require.Equal(t, sd.err, send(sd, cfg))
+		require.Equal(t, 1, sd.calls)
+	})
+
+	t.Run("RetryAfterHonored", func(t *testing.T) {
+		after := time.Millisecond * 50
+		sd := &flaky{fails: 1, err: app.RateLimitError{Err: errors.New("rate limited"), After: after}}
+
+		start := time.Now()
+		require.Nil(t, send(sd, cfg))
+		require.True(t, time.Since(start) >= after)
+		require.Equal(t, 2, sd.calls)
+	})
+
+	t.Run("BackoffIsBounded", func(t *testing.T) {
+		sd := &flaky{fails: 10, err: errors.New("unavailable")}
+		c := cfg
+		c.Attempts = 10
+
+		start := time.Now()
+		send(sd, c)
+		require.True(t, time.Since(start) < c.MaxDelay*time.Duration(c.Attempts)*2)
+		require.Equal(t, c.Attempts, sd.calls)
+	})
+
+	t.Run("BatchRetriesFailedEmailsOnly", func(t *testing.T) {
+		sd := &recipients{
+			calls: map[string]int{},
+			fails: map[string]int{"b@mail.com": 2, "c@mail.com": 5},
+		}
+
+		msgs := []model.Message{}
+		for _, to := range []string{"a@mail.com", "b@mail.com", "c@mail.com"} {
+			msgs = append(msgs, model.Message{To: []model.Address{{Email: to}}})
+		}
+
+		ids, errs := retry.New(sd, cfg).SendBatch(msgs)
+		require.Equal(t, []string{"a@mail.com", "b@mail.com", ""}, ids)
+		require.Nil(t, errs[0])
+		require.Nil(t, errs[1])
+		require.NotNil(t, errs[2])
+		require.Equal(t, map[string]int{
+			"a@mail.com": 1,
+			"b@mail.com": 3,
+			"c@mail.com": 3,
+		}, sd.calls)
+	})
+}
@@ -0,0 +1,273 @@
+package rpc_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/model"
+	"github.com/vbogretsov/sendmail/rpc"
+	"github.com/vbogretsov/sendmail/rpc/pb"
+
+	"github.com/vbogretsov/sendmail/test/api/fixture"
+	"github.com/vbogretsov/sendmail/test/api/loader"
+	"github.com/vbogretsov/sendmail/test/api/sender"
+)
+
+const bufsize = 1 << 20
+
+func defaultRequest(t *testing.T) *pb.MailRequest {
+	args, err := structpb.NewStruct(map[string]interface{}{
+		"Username": "SuperUser",
+	})
+	require.Nil(t, err)
+
+	return &pb.MailRequest{
+		TemplateLang: loader.Lang,
+		TemplateName: loader.TemplateValid,
+		TemplateArgs: args,
+		To:           []*pb.Address{{Email: "user@mail.com"}},
+	}
+}
+
+func request(t *testing.T, req model.Request) *pb.MailRequest {
+	args, err := structpb.NewStruct(req.TemplateArgs)
+	require.Nil(t, err)
+
+	return &pb.MailRequest{
+		TemplateLang: req.TemplateLang,
+		TemplateName: req.TemplateName,
+		TemplateArgs: args,
+		To:           addresses(req.To),
+		Cc:           addresses(req.Cc),
+		Bcc:          addresses(req.Bcc),
+	}
+}
+
+func addresses(in []model.Address) []*pb.Address {
+	out := []*pb.Address{}
+	for _, a := range in {
+		out = append(out, &pb.Address{Email: a.Email, Name: a.Name})
+	}
+	return out
+}
+
+// details extracts validation errors in the fixture format from a status.
+func details(t *testing.T, st *status.Status) []fixture.JsonError {
+	require.Len(t, st.Details(), 1)
+
+	errs, ok := st.Details()[0].(*pb.Errors)
+	require.True(t, ok)
+
+	out := []fixture.JsonError{}
+	for _, e := range errs.Errors {
+		item := fixture.JsonError{Path: e.Path, Error: e.Error}
+		if e.Params != nil {
+			item.Params = fixture.Params(e.Params.AsMap())
+		}
+		out = append(out, item)
+	}
+	return out
+}
+
+func TestRpc(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	sd := sender.New()
+	ap := app.New(loader.New(), sd, app.Config{})
+
+	lis := bufconn.Listen(bufsize)
+	srv := rpc.New(ap, "")
+	go srv.Serve(lis)
+	defer srv.Shutdown(time.Second)
+
+	cn, err := grpc.NewClient(
+		"passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.Nil(t, err)
+	defer cn.Close()
+
+	cl := pb.NewMailerClient(cn)
+	ctx := context.Background()
+
+	for _, fx := range fixture.Fixtures {
+		t.Run(fx.Name, func(t *testing.T) {
+			_, err := cl.SendMail(ctx, request(t, fx.Request))
+			require.NotNil(t, err)
+
+			st := status.Convert(err)
+			require.Contains(t, []codes.Code{
+				codes.InvalidArgument,
+				codes.FailedPrecondition,
+			}, st.Code())
+			require.Equal(t, fx.Errors, details(t, st))
+		})
+	}
+
+	t.Run("InvalidTemplate", func(t *testing.T) {
+		req := defaultRequest(t)
+		req.TemplateName = loader.TemplateMissingSubject
+
+		_, err := cl.SendMail(ctx, req)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+
+	t.Run("MailSent", func(t *testing.T) {
+		res, err := cl.SendMail(ctx, defaultRequest(t))
+		require.Nil(t, err)
+		require.NotEmpty(t, res.Id)
+		require.Equal(t, fmt.Sprint(len(sd.Inbox)), res.MessageId)
+
+		exp := model.Message{
+			Subject:  "Subject",
+			From:     model.Address{Email: "user@mail.com", Name: "Sender"},
+			BodyType: "text/plain",
+			Body:     fmt.Sprintf(loader.ExpectedBody, "SuperUser"),
+			Lang:     loader.Lang,
+			To:       []model.Address{{Email: "user@mail.com"}},
+			Cc:       []model.Address{},
+			Bcc:      []model.Address{},
+		}
+		require.Equal(t, exp, sd.Inbox[len(sd.Inbox)-1])
+	})
+
+	t.Run("SendFailed", func(t *testing.T) {
+		sd.Error = errors.New("send failed")
+		defer func() {
+			sd.Error = nil
+		}()
+
+		_, err := cl.SendMail(ctx, defaultRequest(t))
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		require.Equal(t, sd.Error.Error(), status.Convert(err).Message())
+	})
+
+	t.Run("SendRejected", func(t *testing.T) {
+		sd.Error = app.PermanentError{Err: errors.New("rejected")}
+		defer func() {
+			sd.Error = nil
+		}()
+
+		_, err := cl.SendMail(ctx, defaultRequest(t))
+		require.Equal(t, codes.Internal, status.Code(err))
+	})
+
+	t.Run("SendBatch", func(t *testing.T) {
+		invalid := defaultRequest(t)
+		invalid.To = nil
+
+		res, err := cl.SendBatch(ctx, &pb.BatchRequest{
+			Requests: []*pb.MailRequest{defaultRequest(t), invalid},
+		})
+		require.Nil(t, err)
+		require.Len(t, res.Results, 2)
+
+		require.Equal(t, int32(codes.OK), res.Results[0].Status.Code)
+		require.Equal(t, fmt.Sprint(len(sd.Inbox)), res.Results[0].MessageId)
+
+		st := status.FromProto(res.Results[1].Status)
+		require.Equal(t, codes.InvalidArgument, st.Code())
+		require.Empty(t, res.Results[1].MessageId)
+		require.Equal(t, []fixture.JsonError{
+			{Path: ".", Error: "missing recipients"},
+		}, details(t, st))
+	})
+
+	t.Run("SendPersonalized", func(t *testing.T) {
+		args, err := structpb.NewStruct(map[string]interface{}{"Username": "Bob"})
+		require.Nil(t, err)
+
+		req := defaultRequest(t)
+		res, err := cl.SendPersonalized(ctx, &pb.PersonalizedRequest{
+			TemplateLang: req.TemplateLang,
+			TemplateName: req.TemplateName,
+			TemplateArgs: req.TemplateArgs,
+			Recipients: []*pb.Recipient{
+				{To: []*pb.Address{{Email: "alice@mail.com"}}},
+				{To: []*pb.Address{{Email: "bob@mail.com"}}, TemplateArgs: args},
+				{},
+			},
+		})
+		require.Nil(t, err)
+		require.Len(t, res.Results, 3)
+
+		require.Equal(t, int32(codes.OK), res.Results[0].Status.Code)
+		require.Equal(t, int32(codes.OK), res.Results[1].Status.Code)
+		require.Equal(t, fmt.Sprint(len(sd.Inbox)), res.Results[1].MessageId)
+		require.Equal(t, fmt.Sprintf(loader.ExpectedBody, "SuperUser"), sd.Inbox[len(sd.Inbox)-2].Body)
+		require.Equal(t, fmt.Sprintf(loader.ExpectedBody, "Bob"), sd.Inbox[len(sd.Inbox)-1].Body)
+
+		st := status.FromProto(res.Results[2].Status)
+		require.Equal(t, codes.InvalidArgument, st.Code())
+		require.Equal(t, []fixture.JsonError{
+			{Path: ".", Error: "missing recipients"},
+		}, details(t, st))
+	})
+
+	t.Run("SendPersonalizedInvalid", func(t *testing.T) {
+		req := defaultRequest(t)
+
+		_, err := cl.SendPersonalized(ctx, &pb.PersonalizedRequest{
+			TemplateLang: req.TemplateLang,
+			TemplateName: req.TemplateName,
+		})
+		st := status.Convert(err)
+		require.Equal(t, codes.InvalidArgument, st.Code())
+		require.Equal(t, []fixture.JsonError{
+			{Path: ".recipients", Error: "missing recipients"},
+		}, details(t, st))
+	})
+
+	t.Run("RenderPreview", func(t *testing.T) {
+		req := defaultRequest(t)
+		req.To = nil
+		count := len(sd.Inbox)
+
+		msg, err := cl.RenderPreview(ctx, req)
+		require.Nil(t, err)
+		require.Equal(t, "Subject", msg.Subject)
+		require.Equal(t, "user@mail.com", msg.From.Email)
+		require.Equal(t, fmt.Sprintf(loader.ExpectedBody, "SuperUser"), msg.Body)
+		require.Empty(t, msg.To)
+		require.Equal(t, count, len(sd.Inbox))
+	})
+
+	t.Run("RenderPreviewInvalidTemplate", func(t *testing.T) {
+		req := defaultRequest(t)
+		req.TemplateName = loader.TemplateMissingBody
+
+		_, err := cl.RenderPreview(ctx, req)
+		st := status.Convert(err)
+		require.Equal(t, codes.FailedPrecondition, st.Code())
+		require.Equal(t, []fixture.JsonError{
+			{Path: ".Body", Error: "cannot be blank"},
+		}, details(t, st))
+	})
+
+	t.Run("RenderPreviewBrokenTemplate", func(t *testing.T) {
+		req := defaultRequest(t)
+		req.TemplateName = loader.TemplateInvalidSyntax
+
+		_, err := cl.RenderPreview(ctx, req)
+		st := status.Convert(err)
+		require.Equal(t, codes.FailedPrecondition, st.Code())
+		require.Len(t, details(t, st), 1)
+	})
+}
@@ -0,0 +1,403 @@
+package sendgrid_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/app/sender"
+	"github.com/vbogretsov/sendmail/model"
+
+	"github.com/vbogretsov/sendmail/test/sendgrid/server"
+)
+
+const (
+	key       = "SG.key"
+	messageID = "sg-message-id"
+)
+
+var defaultMessage = model.Message{
+	From:     model.Address{Email: "sender@mail.com", Name: "Sender"},
+	To:       []model.Address{{Email: "to@mail.com", Name: "Receiver"}},
+	Cc:       []model.Address{},
+	Bcc:      []model.Address{{Email: "bcc@mail.com"}},
+	Subject:  "Subject",
+	BodyType: "text/plain",
+	Body:     "Hello SuperUser!\nThis is test body!\n",
+}
+
+const defaultPayload = `{
+	"personalizations": [
+		{
+			"to": [{"email": "to@mail.com", "name": "Receiver"}],
+			"bcc": [{"email": "bcc@mail.com"}]
+		}
+	],
+	"from": {"email": "sender@mail.com", "name": "Sender"},
+	"subject": "Subject",
+	"content": [
+		{"type": "text/plain", "value": "Hello SuperUser!\nThis is test body!\n"}
+	]
+}`
+
+const attachmentsPayload = `{
+	"personalizations": [
+		{
+			"to": [{"email": "to@mail.com", "name": "Receiver"}],
+			"bcc": [{"email": "bcc@mail.com"}]
+		}
+	],
+	"from": {"email": "sender@mail.com", "name": "Sender"},
+	"subject": "Subject",
+	"content": [
+		{"type": "text/plain", "value": "Hello SuperUser!\nThis is test body!\n"}
+	],
+	"attachments": [
+		{
+			"content": "JVBERi0xLjQ=",
+			"type": "application/pdf",
+			"filename": "invoice.pdf",
+			"disposition": "attachment"
+		},
+		{
+			"content": "iVBORw==",
+			"type": "image/png",
+			"filename": "logo.png",
+			"disposition": "inline",
+			"content_id": "logo"
+		}
+	]
+}`
+
+const textPayload = `{
+	"personalizations": [
+		{
+			"to": [{"email": "to@mail.com", "name": "Receiver"}],
+			"bcc": [{"email": "bcc@mail.com"}]
+		}
+	],
+	"from": {"email": "sender@mail.com", "name": "Sender"},
+	"subject": "Subject",
+	"content": [
+		{"type": "text/plain", "value": "Hello"},
+		{"type": "text/html", "value": "<p>Hello</p>"}
+	]
+}`
+
+const headersPayload = `{
+	"personalizations": [
+		{
+			"to": [{"email": "to@mail.com", "name": "Receiver"}],
+			"bcc": [{"email": "bcc@mail.com"}]
+		}
+	],
+	"from": {"email": "sender@mail.com", "name": "Sender"},
+	"reply_to": {"email": "support@mail.com"},
+	"subject": "Subject",
+	"content": [
+		{"type": "text/plain", "value": "Hello SuperUser!\nThis is test body!\n"}
+	],
+	"headers": {"List-Unsubscribe": "<https://mail.com/unsubscribe>"},
+	"categories": ["digest"],
+	"custom_args": {"campaign": "spring"}
+}`
+
+const batchPayload = `{
+	"personalizations": [
+		{
+			"to": [{"email": "a@mail.com"}],
+			"subject": "Digest for A",
+			"custom_args": {"user": "a"}
+		},
+		{
+			"to": [{"email": "b@mail.com"}],
+			"subject": "Digest for B",
+			"headers": {"X-User": "b"},
+			"custom_args": {"user": "b"}
+		}
+	],
+	"from": {"email": "sender@mail.com", "name": "Sender"},
+	"subject": "Digest for A",
+	"content": [
+		{"type": "text/plain", "value": "Digest"}
+	],
+	"categories": ["digest"]
+}`
+
+func send(sd app.Sender) error {
+	_, err := sd.Send(defaultMessage)
+	return err
+}
+
+func TestSendGrid(t *testing.T) {
+	srv := server.New()
+	defer srv.Close()
+
+	sd, err := sender.New("sendgrid", srv.URL(), key)
+	require.Nil(t, err)
+
+	t.Run("MailSent", func(t *testing.T) {
+		defer srv.Reset()
+		srv.Headers = map[string]string{"X-Message-Id": messageID}
+
+		id, err := sd.Send(defaultMessage)
+		require.Nil(t, err)
+		require.Equal(t, messageID, id)
+
+		reqs := srv.Requests()
+		require.Len(t, reqs, 1)
+
+		act := reqs[0]
+		require.Equal(t, http.MethodPost, act.Method)
+		require.Equal(t, "/v3/mail/send", act.Path)
+		require.Equal(t, "Bearer "+key, act.Authorization)
+		require.JSONEq(t, defaultPayload, string(act.Body))
+	})
+
+	t.Run("MailSentWithAttachments", func(t *testing.T) {
+		defer srv.Reset()
+
+		msg := defaultMessage
+		msg.Attachments = []model.Attachment{
+			{
+				Filename:    "invoice.pdf",
+				ContentType: "application/pdf",
+				Content:     "JVBERi0xLjQ=",
+				Disposition: "attachment",
+			},
+			{
+				Filename:    "logo.png",
+				ContentType: "image/png",
+				Content:     "iVBORw==",
+				Disposition: "inline",
+				ContentID:   "logo",
+			},
+		}
+
+		_, err := sd.Send(msg)
+		require.Nil(t, err)
+
+		reqs := srv.Requests()
+		require.Len(t, reqs, 1)
+		require.JSONEq(t, attachmentsPayload, string(reqs[0].Body))
+	})
+
+	t.Run("MailSentWithText", func(t *testing.T) {
+		defer srv.Reset()
+
+		msg := defaultMessage
+		msg.BodyType = "text/html"
+		msg.Body = "<p>Hello</p>"
+		msg.Text = "Hello"
+
+		_, err := sd.Send(msg)
+		require.Nil(t, err)
+
+		reqs := srv.Requests()
+		require.Len(t, reqs, 1)
+		require.JSONEq(t, textPayload, string(reqs[0].Body))
+	})
+
+	t.Run("MailSentWithHeaders", func(t *testing.T) {
+		defer srv.Reset()
+
+		msg := defaultMessage
+		msg.ReplyTo = []model.Address{{Email: "support@mail.com"}}
+		msg.Headers = map[string]string{"List-Unsubscribe": "<https://mail.com/unsubscribe>"}
+		msg.Tags = []string{"digest"}
+		msg.Metadata = map[string]string{"campaign": "spring"}
+
+		_, err := sd.Send(msg)
+		require.Nil(t, err)
+
+		reqs := srv.Requests()
+		require.Len(t, reqs, 1)
+		require.JSONEq(t, headersPayload, string(reqs[0].Body))
+	})
+
+	t.Run("MailSentWithReplyToList", func(t *testing.T) {
+		defer srv.Reset()
+
+		msg := defaultMessage
+		msg.ReplyTo = []model.Address{{Email: "a@mail.com"}, {Email: "b@mail.com"}}
+
+		_, err := sd.Send(msg)
+		require.Nil(t, err)
+
+		reqs := srv.Requests()
+		require.Len(t, reqs, 1)
+
+		var act map[string]interface{}
+		require.Nil(t, json.Unmarshal(reqs[0].Body, &act))
+		require.NotContains(t, act, "reply_to")
+		require.Equal(t, []interface{}{
+			map[string]interface{}{"email": "a@mail.com"},
+			map[string]interface{}{"email": "b@mail.com"},
+		}, act["reply_to_list"])
+	})
+
+	t.Run("BatchSentAsPersonalizations", func(t *testing.T) {
+		defer srv.Reset()
+		srv.Headers = map[string]string{"X-Message-Id": messageID}
+
+		digest := func(to, subject string) model.Message {
+			return model.Message{
+				From:     defaultMessage.From,
+				To:       []model.Address{{Email: to}},
+				Subject:  subject,
+				BodyType: "text/plain",
+				Body:     "Digest",
+				Tags:     []string{"digest"},
+				Metadata: map[string]string{"user": to[:1]},
+			}
+		}
+
+		b := digest("b@mail.com", "Digest for B")
+		b.Headers = map[string]string{"X-User": "b"}
+
+		ids, errs := app.Dispatch(sd, []model.Message{
+			digest("a@mail.com", "Digest for A"),
+			defaultMessage,
+			b,
+		})
+		require.Equal(t, []error{nil, nil, nil}, errs)
+		require.Equal(t, []string{messageID, messageID, messageID}, ids)
+
+		reqs := srv.Requests()
+		require.Len(t, reqs, 2)
+		require.JSONEq(t, batchPayload, string(reqs[0].Body))
+
+		var act struct {
+			Personalizations []interface{} `json:"personalizations"`
+		}
+		require.Nil(t, json.Unmarshal(reqs[1].Body, &act))
+		require.Len(t, act.Personalizations, 1)
+	})
+
+	t.Run("BatchSplitByBody", func(t *testing.T) {
+		defer srv.Reset()
+
+		a := defaultMessage
+		a.Body = "Hello A"
+		b := defaultMessage
+		b.Body = "Hello B"
+
+		_, errs := app.Dispatch(sd, []model.Message{a, b, a})
+		require.Equal(t, []error{nil, nil, nil}, errs)
+
+		reqs := srv.Requests()
+		require.Len(t, reqs, 2)
+
+		var act struct {
+			Personalizations []interface{} `json:"personalizations"`
+		}
+		require.Nil(t, json.Unmarshal(reqs[0].Body, &act))
+		require.Len(t, act.Personalizations, 2)
+	})
+
+	t.Run("BatchBccOnly", func(t *testing.T) {
+		defer srv.Reset()
+
+		msg := defaultMessage
+		msg.To = nil
+
+		_, errs := app.Dispatch(sd, []model.Message{msg, msg})
+		require.Equal(t, []error{nil, nil}, errs)
+
+		reqs := srv.Requests()
+		require.Len(t, reqs, 1)
+
+		var act struct {
+			Personalizations []map[string]interface{} `json:"personalizations"`
+		}
+		require.Nil(t, json.Unmarshal(reqs[0].Body, &act))
+		require.Len(t, act.Personalizations, 2)
+		require.NotContains(t, act.Personalizations[0], "to")
+	})
+
+	t.Run("BatchSplitIntoChunks", func(t *testing.T) {
+		defer srv.Reset()
+
+		msgs := make([]model.Message, 1001)
+		for n := range msgs {
+			msgs[n] = defaultMessage
+		}
+
+		_, errs := app.Dispatch(sd, msgs)
+		require.Len(t, errs, 1001)
+
+		reqs := srv.Requests()
+		require.Len(t, reqs, 2)
+
+		var act struct {
+			Personalizations []interface{} `json:"personalizations"`
+		}
+		require.Nil(t, json.Unmarshal(reqs[0].Body, &act))
+		require.Len(t, act.Personalizations, 1000)
+		require.Nil(t, json.Unmarshal(reqs[1].Body, &act))
+		require.Len(t, act.Personalizations, 1)
+	})
+
+	t.Run("BatchFailedPerChunk", func(t *testing.T) {
+		defer srv.Reset()
+		srv.Status = http.StatusServiceUnavailable
+
+		_, errs := app.Dispatch(sd, []model.Message{defaultMessage, defaultMessage})
+		require.Len(t, errs, 2)
+		for _, err := range errs {
+			require.IsType(t, app.TransientError{}, err)
+		}
+	})
+
+	t.Run("MailSentIfStatusOK", func(t *testing.T) {
+		defer srv.Reset()
+		srv.Status = http.StatusOK
+
+		require.Nil(t, send(sd))
+	})
+
+	errs := []struct {
+		code int
+		err  error
+	}{
+		{code: http.StatusBadRequest, err: app.PermanentError{}},
+		{code: http.StatusRequestEntityTooLarge, err: app.PermanentError{}},
+		{code: http.StatusUnauthorized, err: app.TransientError{}},
+		{code: http.StatusForbidden, err: app.TransientError{}},
+		{code: http.StatusInternalServerError, err: app.TransientError{}},
+		{code: http.StatusServiceUnavailable, err: app.TransientError{}},
+		{code: http.StatusTooManyRequests, err: app.RateLimitError{}},
+	}
+
+	for _, e := range errs {
+		t.Run(http.StatusText(e.code), func(t *testing.T) {
+			defer srv.Reset()
+			srv.Status = e.code
+			srv.Response = `{"errors":[{"message":"error"}]}`
+
+			err := send(sd)
+			require.IsType(t, e.err, err)
+		})
+	}
+
+	t.Run("RetryAfterIfRateLimited", func(t *testing.T) {
+		defer srv.Reset()
+		srv.Status = http.StatusTooManyRequests
+		srv.Headers = map[string]string{"Retry-After": "7"}
+
+		err := send(sd)
+		require.IsType(t, app.RateLimitError{}, err)
+		require.Equal(t, time.Second*7, err.(app.RateLimitError).RetryAfter())
+	})
+
+	t.Run("TransientErrorIfUnreachable", func(t *testing.T) {
+		sd, err := sender.New("sendgrid", "http://127.0.0.1:1", key)
+		require.Nil(t, err)
+
+		require.IsType(t, app.TransientError{}, send(sd))
+	})
+}
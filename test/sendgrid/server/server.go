@@ -0,0 +1,89 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Request represents a request received by the server.
+type Request struct {
+	Method        string
+	Path          string
+	Authorization string
+	ContentType   string
+	Body          []byte
+}
+
+// Server represents a fake SendGrid API server.
+type Server struct {
+	mutex  sync.Mutex
+	server *httptest.Server
+	Inbox  []Request
+	// Status is the response status code, 202 Accepted by default.
+	Status int
+	// Response is the response body.
+	Response string
+	// Headers are the response headers.
+	Headers map[string]string
+}
+
+// New starts a new fake SendGrid API server.
+func New() *Server {
+	srv := &Server{Status: http.StatusAccepted}
+	srv.server = httptest.NewServer(http.HandlerFunc(srv.handle))
+	return srv
+}
+
+// URL gets the server base URL.
+func (self *Server) URL() string {
+	return self.server.URL
+}
+
+// Close stops the server.
+func (self *Server) Close() {
+	self.server.Close()
+}
+
+// Requests gets a copy of received requests.
+func (self *Server) Requests() []Request {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]Request{}, self.Inbox...)
+}
+
+// Reset clears received requests and restores default response.
+func (self *Server) Reset() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.Inbox = nil
+	self.Status = http.StatusAccepted
+	self.Response = ""
+	self.Headers = nil
+}
+
+func (self *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.Inbox = append(self.Inbox, Request{
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		Authorization: r.Header.Get("Authorization"),
+		ContentType:   r.Header.Get("Content-Type"),
+		Body:          body,
+	})
+
+	for k, v := range self.Headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(self.Status)
+	w.Write([]byte(self.Response))
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Username = "user"
+	Password = "secret"
+)
+
+// Mail represents a message received by the server.
+type Mail struct {
+	From string
+	To   []string
+	Data []byte
+	Auth string
+	TLS  bool
+}
+
+// Server represents an in-process SMTP server.
+type Server struct {
+	mutex    sync.Mutex
+	listener net.Listener
+	tls      *tls.Config
+	implicit bool
+	inbox    []Mail
+	reply    string
+}
+
+// New starts a new SMTP server offering STARTTLS.
+func New() (*Server, error) {
+	return start(false)
+}
+
+// NewTLS starts a new SMTP server accepting implicit TLS connections.
+func NewTLS() (*Server, error) {
+	return start(true)
+}
+
+func start(implicit bool) (*Server, error) {
+	cfg, err := config()
+	if err != nil {
+		return nil, err
+	}
+
+	var ln net.Listener
+	if implicit {
+		ln, err = tls.Listen("tcp", "127.0.0.1:0", cfg)
+	} else {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Server{listener: ln, tls: cfg, implicit: implicit}
+	go srv.serve()
+	return srv, nil
+}
+
+// Addr gets the server address.
+func (self *Server) Addr() string {
+	return self.listener.Addr().String()
+}
+
+// Port gets the server port.
+func (self *Server) Port() string {
+	_, port, _ := net.SplitHostPort(self.Addr())
+	return port
+}
+
+// Close stops the server.
+func (self *Server) Close() error {
+	return self.listener.Close()
+}
+
+// Mails gets a copy of received mails.
+func (self *Server) Mails() []Mail {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]Mail{}, self.inbox...)
+}
+
+// Reply overrides the reply to the RCPT command if not empty.
+func (self *Server) Reply(reply string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.reply = reply
+}
+
+// Reset clears received mails and restores the default reply.
+func (self *Server) Reset() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.inbox = nil
+	self.reply = ""
+}
+
+func (self *Server) serve() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			return
+		}
+		go self.handle(conn)
+	}
+}
+
+type session struct {
+	conn net.Conn
+	text *textproto.Conn
+	mail Mail
+}
+
+func (s *session) reply(code int, msg string) {
+	s.text.PrintfLine("%d %s", code, msg)
+}
+
+func (self *Server) handle(conn net.Conn) {
+	s := &session{conn: conn, text: textproto.NewConn(conn)}
+	s.mail.TLS = self.implicit
+	defer s.text.Close()
+
+	s.reply(220, "localhost ESMTP test")
+
+	for {
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, arg := line, ""
+		if n := strings.Index(line, " "); n != -1 {
+			cmd, arg = line[:n], line[n+1:]
+		}
+
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			lines := []string{"localhost", "AUTH PLAIN LOGIN CRAM-MD5"}
+			if !s.mail.TLS {
+				lines = append(lines, "STARTTLS")
+			}
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				s.text.PrintfLine("250%s%s", sep, l)
+			}
+		case "STARTTLS":
+			s.reply(220, "ready to start TLS")
+			tc := tls.Server(s.conn, self.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			s.conn = tc
+			s.text = textproto.NewConn(tc)
+			s.mail.TLS = true
+		case "AUTH":
+			if user, ok := s.auth(arg); ok {
+				s.mail.Auth = user
+				s.reply(235, "authenticated")
+			} else {
+				s.reply(535, "authentication failed")
+			}
+		case "MAIL":
+			s.mail.From = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			s.mail.To = nil
+			s.reply(250, "ok")
+		case "RCPT":
+			self.mutex.Lock()
+			reply := self.reply
+			self.mutex.Unlock()
+			if reply != "" {
+				s.text.PrintfLine(reply)
+				continue
+			}
+			s.mail.To = append(s.mail.To, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			s.reply(250, "ok")
+		case "DATA":
+			s.reply(354, "go ahead")
+			data, err := s.text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			m := s.mail
+			m.Data = bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+			self.mutex.Lock()
+			self.inbox = append(self.inbox, m)
+			self.mutex.Unlock()
+			s.reply(250, "queued")
+		case "RSET", "NOOP":
+			s.reply(250, "ok")
+		case "QUIT":
+			s.reply(221, "bye")
+			return
+		default:
+			s.reply(502, "command not implemented")
+		}
+	}
+}
+
+func (s *session) auth(arg string) (string, bool) {
+	parts := strings.Fields(arg)
+	if len(parts) == 0 {
+		return "", false
+	}
+
+	switch strings.ToUpper(parts[0]) {
+	case "PLAIN":
+		resp := ""
+		if len(parts) > 1 {
+			resp = parts[1]
+		} else {
+			resp = s.challenge("")
+		}
+		data, err := base64.StdEncoding.DecodeString(resp)
+		if err != nil {
+			return "", false
+		}
+		fields := strings.Split(string(data), "\x00")
+		if len(fields) != 3 {
+			return "", false
+		}
+		return fields[1], fields[1] == Username && fields[2] == Password
+	case "LOGIN":
+		user := decode(s.challenge("Username:"))
+		pass := decode(s.challenge("Password:"))
+		return user, user == Username && pass == Password
+	case "CRAM-MD5":
+		nonce := fmt.Sprintf("<%d@localhost>", time.Now().UnixNano())
+		fields := strings.Fields(decode(s.challenge(nonce)))
+		if len(fields) != 2 {
+			return "", false
+		}
+		mac := hmac.New(md5.New, []byte(Password))
+		mac.Write([]byte(nonce))
+		exp := hex.EncodeToString(mac.Sum(nil))
+		return fields[0], fields[0] == Username && fields[1] == exp
+	default:
+		return "", false
+	}
+}
+
+func (s *session) challenge(msg string) string {
+	s.reply(334, base64.StdEncoding.EncodeToString([]byte(msg)))
+	line, _ := s.text.ReadLine()
+	return line
+}
+
+func decode(s string) string {
+	data, _ := base64.StdEncoding.DecodeString(s)
+	return string(data)
+}
+
+func config() (*tls.Config, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	tpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
@@ -0,0 +1,426 @@
+package smtp_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vbogretsov/sendmail/app"
+	"github.com/vbogretsov/sendmail/app/sender"
+	"github.com/vbogretsov/sendmail/model"
+
+	"github.com/vbogretsov/sendmail/test/smtp/server"
+)
+
+var defaultMessage = model.Message{
+	From:     model.Address{Email: "sender@mail.com", Name: "Sender"},
+	To:       []model.Address{{Email: "to@mail.com", Name: "Получатель"}},
+	Cc:       []model.Address{{Email: "cc@mail.com"}},
+	Bcc:      []model.Address{{Email: "bcc@mail.com"}},
+	Subject:  "Привет",
+	BodyType: "text/plain",
+	Body:     "Hello SuperUser!\nThis is test body!\n",
+}
+
+func send(t *testing.T, url string, msg model.Message) error {
+	sd, err := sender.New("smtp", url, server.Password)
+	require.Nil(t, err)
+
+	_, err = sd.Send(msg)
+	return err
+}
+
+func parse(t *testing.T, data []byte) (*mail.Message, string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	require.Nil(t, err)
+
+	return msg, string(body)
+}
+
+func TestSMTP(t *testing.T) {
+	srv, err := server.New()
+	require.Nil(t, err)
+	defer srv.Close()
+
+	tlssrv, err := server.NewTLS()
+	require.Nil(t, err)
+	defer tlssrv.Close()
+
+	t.Run("MailSent", func(t *testing.T) {
+		url := fmt.Sprintf("smtp://%s?starttls=disabled", srv.Addr())
+		sd, err := sender.New("smtp", url, "")
+		require.Nil(t, err)
+
+		id, err := sd.Send(defaultMessage)
+		require.Nil(t, err)
+
+		mails := srv.Mails()
+		require.Len(t, mails, 1)
+
+		act := mails[0]
+		require.Equal(t, "sender@mail.com", act.From)
+		require.Equal(t, []string{"to@mail.com", "cc@mail.com", "bcc@mail.com"}, act.To)
+		require.False(t, act.TLS)
+		require.Empty(t, act.Auth)
+
+		msg, body := parse(t, act.Data)
+
+		to, err := mail.ParseAddressList(msg.Header.Get("To"))
+		require.Nil(t, err)
+		require.Equal(t, []*mail.Address{{Name: "Получатель", Address: "to@mail.com"}}, to)
+
+		subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		require.Nil(t, err)
+		require.Equal(t, defaultMessage.Subject, subject)
+
+		require.Equal(t, `"Sender" <sender@mail.com>`, msg.Header.Get("From"))
+		require.Equal(t, "<cc@mail.com>", msg.Header.Get("Cc"))
+		require.Empty(t, msg.Header.Get("Bcc"))
+		require.Equal(t, id, msg.Header.Get("Message-ID"))
+		require.NotEmpty(t, msg.Header.Get("Date"))
+		require.Equal(t, "1.0", msg.Header.Get("MIME-Version"))
+		require.Equal(t, "text/plain; charset=utf-8", msg.Header.Get("Content-Type"))
+		require.Equal(t, "Hello SuperUser!\r\nThis is test body!\r\n", body)
+	})
+
+	t.Run("MailSentWithAttachments", func(t *testing.T) {
+		srv.Reset()
+
+		content := strings.Repeat("%PDF-1.4 ", 20)
+
+		msg := defaultMessage
+		msg.Attachments = []model.Attachment{
+			{
+				Filename:    "счёт.pdf",
+				ContentType: "application/pdf",
+				Content:     base64.StdEncoding.EncodeToString([]byte(content)),
+				Disposition: "attachment",
+			},
+		}
+
+		url := fmt.Sprintf("smtp://%s?starttls=disabled", srv.Addr())
+		require.Nil(t, send(t, url, msg))
+
+		mails := srv.Mails()
+		require.Len(t, mails, 1)
+
+		act, err := mail.ReadMessage(bytes.NewReader(mails[0].Data))
+		require.Nil(t, err)
+
+		mt, params, err := mime.ParseMediaType(act.Header.Get("Content-Type"))
+		require.Nil(t, err)
+		require.Equal(t, "multipart/mixed", mt)
+
+		mr := multipart.NewReader(act.Body, params["boundary"])
+
+		part, err := mr.NextPart()
+		require.Nil(t, err)
+		require.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(part)
+		require.Nil(t, err)
+		require.Equal(t, "Hello SuperUser!\r\nThis is test body!\r\n", string(body))
+
+		part, err = mr.NextPart()
+		require.Nil(t, err)
+		require.Equal(t, "base64", part.Header.Get("Content-Transfer-Encoding"))
+		require.Equal(t, "счёт.pdf", part.FileName())
+
+		ct, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		require.Nil(t, err)
+		require.Equal(t, "application/pdf", ct)
+
+		data, err := ioutil.ReadAll(part)
+		require.Nil(t, err)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\r\n") {
+			require.True(t, len(line) <= 76)
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		require.Nil(t, err)
+		require.Equal(t, content, string(decoded))
+
+		_, err = mr.NextPart()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("MailSentWithInlineImages", func(t *testing.T) {
+		srv.Reset()
+
+		msg := defaultMessage
+		msg.BodyType = "text/html"
+		msg.Body = `<img src="cid:logo">`
+		msg.Attachments = []model.Attachment{
+			{
+				Filename:    "logo.png",
+				ContentType: "image/png",
+				Content:     base64.StdEncoding.EncodeToString([]byte("PNG")),
+				Disposition: "inline",
+				ContentID:   "logo",
+			},
+			{
+				Filename:    "terms.txt",
+				ContentType: "text/plain",
+				Content:     base64.StdEncoding.EncodeToString([]byte("terms")),
+				Disposition: "attachment",
+			},
+		}
+
+		url := fmt.Sprintf("smtp://%s?starttls=disabled", srv.Addr())
+		require.Nil(t, send(t, url, msg))
+
+		mails := srv.Mails()
+		require.Len(t, mails, 1)
+
+		act, err := mail.ReadMessage(bytes.NewReader(mails[0].Data))
+		require.Nil(t, err)
+
+		mt, params, err := mime.ParseMediaType(act.Header.Get("Content-Type"))
+		require.Nil(t, err)
+		require.Equal(t, "multipart/mixed", mt)
+
+		mixed := multipart.NewReader(act.Body, params["boundary"])
+
+		part, err := mixed.NextPart()
+		require.Nil(t, err)
+		mt, params, err = mime.ParseMediaType(part.Header.Get("Content-Type"))
+		require.Nil(t, err)
+		require.Equal(t, "multipart/related", mt)
+		require.Equal(t, "text/html", params["type"])
+
+		related := multipart.NewReader(part, params["boundary"])
+
+		html, err := related.NextPart()
+		require.Nil(t, err)
+		require.Equal(t, "text/html; charset=utf-8", html.Header.Get("Content-Type"))
+
+		img, err := related.NextPart()
+		require.Nil(t, err)
+		require.Equal(t, "<logo>", img.Header.Get("Content-ID"))
+		require.Equal(t, "logo.png", img.FileName())
+		require.Contains(t, img.Header.Get("Content-Disposition"), "inline")
+
+		_, err = related.NextPart()
+		require.Equal(t, io.EOF, err)
+
+		part, err = mixed.NextPart()
+		require.Nil(t, err)
+		require.Equal(t, "terms.txt", part.FileName())
+
+		_, err = mixed.NextPart()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("MailSentWithText", func(t *testing.T) {
+		srv.Reset()
+
+		msg := defaultMessage
+		msg.BodyType = "text/html"
+		msg.Body = `<img src="cid:logo">`
+		msg.Text = "Hello"
+		msg.Attachments = []model.Attachment{
+			{
+				Filename:    "logo.png",
+				ContentType: "image/png",
+				Content:     base64.StdEncoding.EncodeToString([]byte("PNG")),
+				Disposition: "inline",
+				ContentID:   "logo",
+			},
+		}
+
+		url := fmt.Sprintf("smtp://%s?starttls=disabled", srv.Addr())
+		require.Nil(t, send(t, url, msg))
+
+		mails := srv.Mails()
+		require.Len(t, mails, 1)
+
+		act, err := mail.ReadMessage(bytes.NewReader(mails[0].Data))
+		require.Nil(t, err)
+
+		mt, params, err := mime.ParseMediaType(act.Header.Get("Content-Type"))
+		require.Nil(t, err)
+		require.Equal(t, "multipart/alternative", mt)
+
+		alt := multipart.NewReader(act.Body, params["boundary"])
+
+		part, err := alt.NextPart()
+		require.Nil(t, err)
+		require.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+		text, err := ioutil.ReadAll(part)
+		require.Nil(t, err)
+		require.Equal(t, "Hello", string(text))
+
+		part, err = alt.NextPart()
+		require.Nil(t, err)
+		mt, _, err = mime.ParseMediaType(part.Header.Get("Content-Type"))
+		require.Nil(t, err)
+		require.Equal(t, "multipart/related", mt)
+
+		_, err = alt.NextPart()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("MailSentWithHeaders", func(t *testing.T) {
+		srv.Reset()
+
+		msg := defaultMessage
+		msg.ReplyTo = []model.Address{{Email: "support@mail.com", Name: "Support"}}
+		msg.Headers = map[string]string{
+			"List-Unsubscribe": "<https://mail.com/unsubscribe>",
+			"X-Entity-Ref-ID":  "Привет",
+		}
+		msg.Tags = []string{"digest", "weekly"}
+		msg.Metadata = map[string]string{"campaign": "spring"}
+
+		url := fmt.Sprintf("smtp://%s?starttls=disabled", srv.Addr())
+		require.Nil(t, send(t, url, msg))
+
+		mails := srv.Mails()
+		require.Len(t, mails, 1)
+
+		act, _ := parse(t, mails[0].Data)
+		require.Equal(t, `"Support" <support@mail.com>`, act.Header.Get("Reply-To"))
+		require.Equal(t, "<https://mail.com/unsubscribe>", act.Header.Get("List-Unsubscribe"))
+		require.Equal(t, "digest, weekly", act.Header.Get("X-Tags"))
+		require.Equal(t, `{"campaign":"spring"}`, act.Header.Get("X-Metadata"))
+
+		ref, err := new(mime.WordDecoder).DecodeHeader(act.Header.Get("X-Entity-Ref-ID"))
+		require.Nil(t, err)
+		require.Equal(t, "Привет", ref)
+	})
+
+	t.Run("MailSentWithLongHeaders", func(t *testing.T) {
+		srv.Reset()
+
+		msg := defaultMessage
+		msg.Subject = strings.TrimSpace(strings.Repeat("Привет мир ", 10))
+		msg.Headers = map[string]string{
+			"X-Note":  strings.TrimSpace(strings.Repeat("note ", 40)),
+			"X-Token": strings.Repeat("t", 100),
+		}
+
+		url := fmt.Sprintf("smtp://%s?starttls=disabled", srv.Addr())
+		require.Nil(t, send(t, url, msg))
+
+		mails := srv.Mails()
+		require.Len(t, mails, 1)
+
+		header := strings.SplitN(string(mails[0].Data), "\r\n\r\n", 2)[0]
+		for _, line := range strings.Split(header, "\r\n") {
+			words := strings.Fields(line)
+			require.True(t, len(line) <= 78 || len(words) <= 2, line)
+			require.False(t, len(words) == 1 && strings.HasSuffix(line, ":"), line)
+		}
+		require.Contains(t, header, "X-Token: "+msg.Headers["X-Token"]+"\r\n")
+
+		act, _ := parse(t, mails[0].Data)
+		require.Equal(t, msg.Headers["X-Note"], act.Header.Get("X-Note"))
+		require.Equal(t, msg.Headers["X-Token"], act.Header.Get("X-Token"))
+
+		subject, err := new(mime.WordDecoder).DecodeHeader(act.Header.Get("Subject"))
+		require.Nil(t, err)
+		require.Equal(t, msg.Subject, subject)
+	})
+
+	t.Run("MailSentBccOnly", func(t *testing.T) {
+		srv.Reset()
+
+		msg := defaultMessage
+		msg.To = nil
+		msg.Cc = nil
+
+		url := fmt.Sprintf("smtp://%s?starttls=disabled", srv.Addr())
+		require.Nil(t, send(t, url, msg))
+
+		mails := srv.Mails()
+		require.Len(t, mails, 1)
+		require.Equal(t, []string{"bcc@mail.com"}, mails[0].To)
+
+		act, _ := parse(t, mails[0].Data)
+		require.Equal(t, "undisclosed-recipients:;", act.Header.Get("To"))
+	})
+
+	auths := []string{"plain", "login", "cram-md5"}
+
+	for _, auth := range auths {
+		t.Run(fmt.Sprintf("StartTLSAuth-%s", auth), func(t *testing.T) {
+			srv.Reset()
+
+			url := fmt.Sprintf(
+				"smtp://%s@localhost:%s?starttls=required&insecure=true&auth=%s",
+				server.Username, srv.Port(), auth)
+			require.Nil(t, send(t, url, defaultMessage))
+
+			mails := srv.Mails()
+			require.Len(t, mails, 1)
+			require.True(t, mails[0].TLS)
+			require.Equal(t, server.Username, mails[0].Auth)
+		})
+
+		t.Run(fmt.Sprintf("ImplicitTLSAuth-%s", auth), func(t *testing.T) {
+			tlssrv.Reset()
+
+			url := fmt.Sprintf(
+				"smtps://%s@localhost:%s?insecure=true&auth=%s",
+				server.Username, tlssrv.Port(), auth)
+			require.Nil(t, send(t, url, defaultMessage))
+
+			mails := tlssrv.Mails()
+			require.Len(t, mails, 1)
+			require.True(t, mails[0].TLS)
+			require.Equal(t, server.Username, mails[0].Auth)
+		})
+	}
+
+	t.Run("ErrorIfAuthFailed", func(t *testing.T) {
+		sd, err := sender.New(
+			"smtp",
+			fmt.Sprintf("smtps://%s@localhost:%s?insecure=true", server.Username, tlssrv.Port()),
+			"wrong")
+		require.Nil(t, err)
+		_, err = sd.Send(defaultMessage)
+		require.IsType(t, app.TransientError{}, err)
+	})
+
+	t.Run("PermanentErrorIfRecipientRejected", func(t *testing.T) {
+		srv.Reply("550 mailbox unavailable")
+		defer srv.Reset()
+
+		url := fmt.Sprintf("smtp://%s?starttls=disabled", srv.Addr())
+		require.IsType(t, app.PermanentError{}, send(t, url, defaultMessage))
+	})
+
+	t.Run("TransientErrorIfRecipientDeferred", func(t *testing.T) {
+		srv.Reply("451 try again later")
+		defer srv.Reset()
+
+		url := fmt.Sprintf("smtp://%s?starttls=disabled", srv.Addr())
+		require.IsType(t, app.TransientError{}, send(t, url, defaultMessage))
+	})
+
+	t.Run("TransientErrorIfUnreachable", func(t *testing.T) {
+		require.IsType(t, app.TransientError{}, send(t, "smtp://127.0.0.1:1", defaultMessage))
+	})
+
+	t.Run("ErrorIfUnsupportedScheme", func(t *testing.T) {
+		_, err := sender.New("smtp", "http://localhost", "")
+		require.NotNil(t, err)
+	})
+
+	t.Run("ErrorIfUnsupportedAuth", func(t *testing.T) {
+		_, err := sender.New("smtp", "smtp://localhost?auth=xxx", "")
+		require.NotNil(t, err)
+	})
+}